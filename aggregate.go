@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// cross-channel magic: a lobby channel runs a spell over a user var
+// from every channel with some prefix (or from a list of channels)
+// member channels publish copies of their values here and poke the lobbies watching them
+
+// which channels a cross-channel magic reads from
+type aggScope struct {
+	prefix   rune     // every channel with this prefix...
+	channels []string // ...or just these
+}
+
+func (m magicDef) scope() aggScope {
+	sc := aggScope{channels: m.Channels}
+	if m.Across != "" {
+		sc.prefix, _ = utf8.DecodeRuneInString(m.Across)
+	}
+	return sc
+}
+
+func (sc aggScope) includes(name string) bool {
+	if sc.prefix != 0 {
+		prefix, _ := utf8.DecodeRuneInString(name)
+		return prefix == sc.prefix
+	}
+	for _, n := range sc.channels {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixes of every channel this scope could include
+func (sc aggScope) prefixes() []rune {
+	if sc.prefix != 0 {
+		return []rune{sc.prefix}
+	}
+	var prefixes []rune
+	for _, n := range sc.channels {
+		prefix, _ := utf8.DecodeRuneInString(n)
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// type of src in the channels we read from
+func (sc aggScope) srcType(tmpls map[rune]channelTemplate, src identifier) jsType {
+	for _, prefix := range sc.prefixes() {
+		if tmpl, ok := tmpls[prefix]; ok && tmpl.Vars[src.name] != nil {
+			return tmpl.Vars[src.name].Type
+		}
+	}
+	return jsAnything
+}
+
+type aggDef struct {
+	scope aggScope
+	src   identifier
+}
+
+var (
+	aggDefs     []aggDef
+	aggValues   = make(map[string]map[identifier]map[*client]interface{}) // channel name → var → values
+	aggWatchers = make(map[*channel][]aggScope)                           // lobbies and what they read
+	aggMutex    = &sync.RWMutex{}
+)
+
+// remembers every cross-channel magic so member channels know what to publish
+func prepareAggregates(tmpls []channelTemplate) {
+	aggMutex.Lock()
+	defer aggMutex.Unlock()
+
+	for _, tmpl := range tmpls {
+		for _, m := range tmpl.Magic {
+			if m.cross() {
+				aggDefs = append(aggDefs, aggDef{m.scope(), m.Src})
+				if m.cond != nil {
+					aggDefs = append(aggDefs, aggDef{m.scope(), m.cond.v})
+				}
+				for _, v := range m.inputs() {
+					aggDefs = append(aggDefs, aggDef{m.scope(), v})
+				}
+			}
+		}
+	}
+}
+
+// user vars a channel needs to publish
+func aggregatedVars(name string) []identifier {
+	aggMutex.RLock()
+	defer aggMutex.RUnlock()
+
+	var vars []identifier
+	for _, def := range aggDefs {
+		if def.scope.includes(name) && !hasIdentifier(vars, def.src) {
+			vars = append(vars, def.src)
+		}
+	}
+	return vars
+}
+
+func publishAggregate(name string, v identifier, values uservarMap) {
+	cp := make(map[*client]interface{}, len(values))
+	for c, val := range values {
+		cp[c] = val
+	}
+
+	aggMutex.Lock()
+	defer aggMutex.Unlock()
+
+	if aggValues[name] == nil {
+		aggValues[name] = make(map[identifier]map[*client]interface{})
+	}
+	aggValues[name][v] = cp
+	pokeAggregators(name)
+}
+
+func dropAggregate(name string) {
+	aggMutex.Lock()
+	defer aggMutex.Unlock()
+
+	delete(aggValues, name)
+	pokeAggregators(name)
+}
+
+// call with aggMutex held
+func pokeAggregators(name string) {
+	for lobby, scopes := range aggWatchers {
+		for _, sc := range scopes {
+			if sc.includes(name) {
+				select {
+				case lobby.poke <- true:
+				default:
+				}
+				break
+			}
+		}
+	}
+}
+
+func watchAggregates(lobby *channel, scopes []aggScope) {
+	aggMutex.Lock()
+	defer aggMutex.Unlock()
+
+	aggWatchers[lobby] = scopes
+}
+
+func unwatchAggregates(lobby *channel) {
+	aggMutex.Lock()
+	defer aggMutex.Unlock()
+
+	delete(aggWatchers, lobby)
+}
+
+// magic source for a user var across channels
+// each user counts once, even if they're in more than one of the channels
+type aggSource struct {
+	scope aggScope
+	v     identifier
+	type_ jsType
+}
+
+func (s aggSource) values() map[*client]interface{} {
+	aggMutex.RLock()
+	defer aggMutex.RUnlock()
+
+	values := make(map[*client]interface{})
+	for name, vars := range aggValues {
+		if !s.scope.includes(name) {
+			continue
+		}
+		for c, val := range vars[s.v] {
+			values[c] = val
+		}
+	}
+	return values
+}
+
+func (s aggSource) srcType() jsType {
+	return s.type_
+}
+
+func (s aggSource) listeners() int {
+	return len(s.values())
+}
@@ -47,7 +47,7 @@ func apiSet(w http.ResponseWriter, r *http.Request) {
 	}
 	ch := getChannel(name)
 	req := apiRequest{}
-	err := routes.ReadJson(r, &req)
+	err := decodeFrom(r.Body, &req)
 	if err != nil {
 		http.Error(w, "bad json", http.StatusBadRequest)
 		return
@@ -93,7 +93,7 @@ func apiGet(w http.ResponseWriter, r *http.Request) {
 	}
 	ch := getChannel(name)
 	req := apiRequest{}
-	err := routes.ReadJson(r, &req)
+	err := decodeFrom(r.Body, &req)
 	if err != nil {
 		http.Error(w, "bad json", http.StatusBadRequest)
 		return
@@ -0,0 +1,42 @@
+package main
+
+// authenticators decide who a login key belongs to
+type authenticator interface {
+	authenticate(key string) (identity, bool)
+}
+
+// who a connection is after logging in
+type identity struct {
+	id    clientID
+	key   string
+	roles []string
+}
+
+func (ident identity) hasRole(role string) bool {
+	for _, r := range ident.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// static table of login keys from the config file ([[login]])
+type keyTable map[string]identity
+
+func newKeyTable(defs []loginDef) keyTable {
+	kt := make(keyTable)
+	for _, def := range defs {
+		kt[def.Key] = identity{
+			id:    clientID(def.ID),
+			key:   def.Key,
+			roles: def.Roles,
+		}
+	}
+	return kt
+}
+
+func (kt keyTable) authenticate(key string) (identity, bool) {
+	ident, ok := kt[key]
+	return ident, ok
+}
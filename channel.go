@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode/utf8"
 )
 
@@ -11,24 +14,48 @@ var channelTable = make(map[string]*channel)
 var channelTableMutex = &sync.RWMutex{}
 
 type channel struct {
-	prefix    rune
-	name      string
-	restrict  []string
-	listeners map[*client]bool
-	index     map[identifier]bool
-	types     map[identifier]jsType
-	wires     map[identifier]wire
-	vars      map[identifier]interface{}
-	uservars  map[identifier]uservarMap
-	magic     map[identifier]func() interface{}
-	cache     map[identifier]interface{}
-	deps      map[identifier][]identifier
+	prefix      rune
+	name        string
+	restrict    []string
+	listeners   map[*client]bool
+	joined      map[*client]time.Time
+	index       map[identifier]bool
+	types       map[identifier]jsType
+	writers     map[identifier][]string // roles or keys allowed to set a var
+	defaults    map[identifier]interface{}
+	limits      map[identifier]*constraints
+	schemas     map[identifier]*schema
+	joins       int // for numbering guests
+	wires       map[identifier]wire
+	vars        map[identifier]interface{}
+	uservars    map[identifier]uservarMap
+	public      map[identifier]bool // user vars everyone can see
+	roster      map[identifier]bool // user vars shown in $users
+	magic       map[identifier]func() interface{}
+	cache       map[identifier]interface{}
+	viewerMagic map[identifier]func() func(*client) interface{} // magic that's different for everyone, see viewerMaker
+	viewerCache map[identifier]uservarMap
+	deps        map[identifier][]identifier
+	order       []identifier           // all magic, each after the magic it reads
+	tallies     map[identifier][]tally // running totals of a user var's magic, see tally.go
+	paced       map[identifier]*pacer  // magic with throttle or debounce, see pace.go
+	alarm       *time.Timer            // goes off when some paced magic is due
+	alarmAt     time.Time
+	wake        <-chan time.Time    // alarm's channel, nil when it's off
+	globals     bool                // exposes server-wide vars?
+	lobby       rune                // prefix of the channels we list in $rooms
+	listed      bool                // are we in some lobby's $rooms?
+	shared      []identifier        // vars to show in $rooms
+	cross       []identifier        // magic reading other channels' values
+	watching    []aggScope          // the channels they read
+	aggregated  map[identifier]bool // our user vars that other channels' magic reads
 
 	get     chan getter
 	set     chan setter
 	join    chan *client
 	part    chan *client
 	deliver chan order
+	poke    chan bool // server-wide stuff changed
 }
 
 func newChannel(name string) *channel {
@@ -38,22 +65,35 @@ func newChannel(name string) *channel {
 		return nil
 	}
 	ch := &channel{
-		name:      name,
-		listeners: make(map[*client]bool),
-		index:     make(map[identifier]bool),
-		types:     make(map[identifier]jsType),
-		wires:     make(map[identifier]wire),
-		vars:      make(map[identifier]interface{}),
-		uservars:  make(map[identifier]uservarMap),
-		magic:     make(map[identifier]func() interface{}),
-		cache:     make(map[identifier]interface{}),
-		deps:      make(map[identifier][]identifier),
+		name:        name,
+		listeners:   make(map[*client]bool),
+		joined:      make(map[*client]time.Time),
+		index:       make(map[identifier]bool),
+		types:       make(map[identifier]jsType),
+		writers:     make(map[identifier][]string),
+		defaults:    make(map[identifier]interface{}),
+		limits:      make(map[identifier]*constraints),
+		schemas:     make(map[identifier]*schema),
+		wires:       make(map[identifier]wire),
+		vars:        make(map[identifier]interface{}),
+		uservars:    make(map[identifier]uservarMap),
+		public:      make(map[identifier]bool),
+		roster:      make(map[identifier]bool),
+		magic:       make(map[identifier]func() interface{}),
+		cache:       make(map[identifier]interface{}),
+		viewerMagic: make(map[identifier]func() func(*client) interface{}),
+		viewerCache: make(map[identifier]uservarMap),
+		deps:        make(map[identifier][]identifier),
+		tallies:     make(map[identifier][]tally),
+		paced:       make(map[identifier]*pacer),
+		aggregated:  make(map[identifier]bool),
 
 		get:     make(chan getter),
 		set:     make(chan setter),
 		join:    make(chan *client),
 		part:    make(chan *client),
 		deliver: make(chan order),
+		poke:    make(chan bool, 1),
 	}
 	cfg.apply(ch)
 	return ch
@@ -66,6 +106,15 @@ func (ch *channel) broadcast(msg interface{}) {
 	}
 }
 
+// write all but one
+func (ch *channel) broadcastExcept(skip *client, msg interface{}) {
+	for c, _ := range ch.listeners {
+		if c != skip {
+			c.send(msg)
+		}
+	}
+}
+
 // notify when vars change
 func (ch *channel) notify(v identifier, value interface{}) {
 	ch.broadcast(setRequest{
@@ -86,18 +135,168 @@ func (ch *channel) notifyOne(c *client, v identifier, value interface{}) {
 	})
 }
 
+// tell everyone about a change to someone's public var
+func (ch *channel) notifyPeers(c *client, v identifier, value interface{}) {
+	ch.broadcast(peerMessage{
+		Cmd:     "u",
+		Channel: ch.name,
+		Var:     v,
+		User:    c.id,
+		Value:   value,
+	})
+}
+
 // re-computes magic values (no sigil needed)
-func (ch *channel) invalidate(v identifier) {
-	if _, exists := ch.deps[v]; exists {
-		for _, dep := range ch.deps[v] {
-			oldVal := ch.cache[dep]
-			newVal := ch.magic[dep]()
-			if oldVal != newVal {
-				ch.cache[dep] = newVal
-				ch.notify(dep, newVal)
+// magic reading more than one of vs is only re-computed once
+func (ch *channel) invalidate(vs ...identifier) {
+	stale := make(map[identifier]bool)
+	for _, v := range vs {
+		for dep := range ch.downstream(v) {
+			stale[dep] = true
+		}
+	}
+	ch.refresh(stale)
+	for _, v := range vs {
+		if ch.aggregated[v] {
+			publishAggregate(ch.name, v, ch.uservars[v])
+		}
+	}
+}
+
+// sets c's value of user var v, keeping its tallies up to date
+func (ch *channel) setUserValue(v identifier, c *client, value interface{}) {
+	values := ch.uservars[v]
+	old, had := values[c]
+	values[c] = value
+	for _, t := range ch.tallies[v] {
+		if had {
+			t.remove(old)
+		}
+		t.add(value)
+	}
+}
+
+// forgets c's value of user var v
+func (ch *channel) dropUserValue(v identifier, c *client) {
+	values := ch.uservars[v]
+	old, had := values[c]
+	if !had {
+		return
+	}
+	delete(values, c)
+	for _, t := range ch.tallies[v] {
+		t.remove(old)
+	}
+}
+
+// source for another user var magic v reads (for where or group)
+// recomputes v when it changes
+func (ch *channel) magicInput(m *magicDef, v, input identifier) magicSource {
+	if m.cross() {
+		sc := m.scope()
+		return aggSource{sc, input, sc.srcType(templates, input)}
+	}
+	ch.deps[input] = append(ch.deps[input], v)
+	return userVarSource{ch, input}
+}
+
+// all the magic that (maybe indirectly) reads v
+func (ch *channel) downstream(v identifier) map[identifier]bool {
+	stale := make(map[identifier]bool)
+	queue := append([]identifier(nil), ch.deps[v]...)
+	for len(queue) > 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		if !stale[dep] {
+			stale[dep] = true
+			queue = append(queue, ch.deps[dep]...)
+		}
+	}
+	return stale
+}
+
+// re-computes the stale magic in order, so magic built on magic sees fresh values
+// paced magic might wait until later, see flushPaced
+func (ch *channel) refresh(stale map[identifier]bool) {
+	now := time.Now()
+	for _, v := range ch.order {
+		if !stale[v] {
+			continue
+		}
+		if p, ok := ch.paced[v]; ok && !p.stale(now) {
+			continue
+		}
+		ch.recompute(v)
+	}
+}
+
+// re-computes one magic value and tells everyone if it changed
+func (ch *channel) recompute(v identifier) {
+	if prep, ok := ch.viewerMagic[v]; ok {
+		f := prep()
+		for c := range ch.listeners {
+			ch.recomputeFor(c, v, f)
+		}
+		return
+	}
+	oldVal := ch.cache[v]
+	newVal := ch.magic[v]()
+	if !equal(oldVal, newVal) {
+		ch.cache[v] = newVal
+		ch.notify(v, newVal)
+	}
+}
+
+// re-computes one viewer's value of per-viewer magic, and tells them if it changed
+func (ch *channel) recomputeFor(c *client, v identifier, f func(*client) interface{}) {
+	oldVal, seen := ch.viewerCache[v][c]
+	newVal := f(c)
+	if !seen || !equal(oldVal, newVal) {
+		ch.viewerCache[v][c] = newVal
+		ch.notifyOne(c, v, newVal)
+	}
+}
+
+// catches up on magic that reads other channels
+func (ch *channel) refreshCross() {
+	stale := make(map[identifier]bool)
+	for _, v := range ch.cross {
+		stale[v] = true
+		for dep := range ch.downstream(v) {
+			stale[dep] = true
+		}
+	}
+	ch.refresh(stale)
+}
+
+// rebuilds $users, if we have it
+func (ch *channel) updateUsers() {
+	if !ch.has(usersSysVar) {
+		return
+	}
+	users := make([]presence, 0, len(ch.listeners))
+	for c := range ch.listeners {
+		p := presence{
+			ID:     c.id,
+			Joined: ch.joined[c].UnixNano() / int64(time.Millisecond),
+		}
+		if len(ch.roster) > 0 {
+			p.Vars = make(map[string]interface{}, len(ch.roster))
+			for v := range ch.roster {
+				p.Vars[v.name] = ch.uservars[v][c]
 			}
 		}
+		users = append(users, p)
+	}
+	sort.Sort(byJoinTime(users))
+	// plain objects, so magic can treat them like any object[]
+	list := make([]map[string]interface{}, len(users))
+	for i, p := range users {
+		list[i] = p.object()
 	}
+	ch.vars[usersSysVar] = list
+	ch.notify(usersSysVar, list)
+	ch.invalidate(usersSysVar)
 }
 
 func (ch *channel) has(v identifier) bool {
@@ -124,8 +323,18 @@ func (ch *channel) value(v identifier, from *client) (val interface{}, err *erro
 			val = ch.uservars[v]
 		}
 	case MagicVar:
-		val = ch.cache[v]
+		if cache, ok := ch.viewerCache[v]; ok {
+			if from != nil {
+				val = cache[from]
+			} else {
+				val = cache.snapshot()
+			}
+		} else {
+			val = ch.cache[v]
+		}
 	case SystemVar:
+		val = ch.sysValue(v, from)
+	case BroadcastVar, ChannelVar:
 		val = ch.vars[v]
 	default:
 		err = channelError(ch, v, "unknown kind")
@@ -134,6 +343,147 @@ func (ch *channel) value(v identifier, from *client) (val interface{}, err *erro
 	return
 }
 
+// current value of a non-user var, even if clients can't see it (like an unexposed $listeners)
+func (ch *channel) peek(v identifier) interface{} {
+	switch v.kind {
+	case MagicVar:
+		return ch.cache[v]
+	case SystemVar:
+		return ch.sysValue(v, nil)
+	}
+	return ch.vars[v]
+}
+
+// catches up on server-wide vars we expose
+func (ch *channel) refreshGlobals() {
+	for v := range ch.index {
+		if !isGlobal(v) {
+			continue
+		}
+		val := globalValue(v)
+		if !equal(ch.vars[v], val) {
+			ch.vars[v] = val
+			ch.notify(v, val)
+			ch.invalidate(v)
+		}
+	}
+}
+
+// catches up on the channels we list in $rooms
+func (ch *channel) refreshRooms() {
+	if ch.lobby == 0 {
+		return
+	}
+	rooms := roomList(ch.lobby)
+	list := make([]map[string]interface{}, len(rooms))
+	for i, info := range rooms {
+		list[i] = info.object()
+	}
+	if !equal(ch.vars[roomsSysVar], list) {
+		ch.vars[roomsSysVar] = list
+		ch.notify(roomsSysVar, list)
+		ch.invalidate(roomsSysVar)
+	}
+}
+
+// our entry in $rooms
+func (ch *channel) roomInfo() roomInfo {
+	info := roomInfo{
+		Name:      ch.name,
+		Listeners: len(ch.listeners),
+	}
+	if len(ch.shared) > 0 {
+		info.Vars = make(map[string]interface{}, len(ch.shared))
+		for _, v := range ch.shared {
+			info.Vars[v.String()] = ch.vars[v]
+		}
+	}
+	return info
+}
+
+// updates our entry in $rooms, if we have one
+func (ch *channel) publishRoom() {
+	if ch.listed {
+		listRoom(ch.roomInfo(), ch.prefix)
+	}
+}
+
+// gets the value of a system var, some of which depend on who's asking
+func (ch *channel) sysValue(v identifier, from *client) interface{} {
+	switch v {
+	case listenersSysVar:
+		return len(ch.listeners)
+	case channelSysVar:
+		return ch.name
+	case serverSysVar:
+		return currentConfig.Server.Name
+	case userIDSysVar:
+		if from == nil {
+			return clientNone
+		}
+		return from.id
+	case joinedAtSysVar:
+		if t, ok := ch.joined[from]; ok {
+			return int(t.UnixNano() / int64(time.Millisecond))
+		}
+		return 0
+	case clientsSysVar, channelsSysVar, uptimeSysVar, timeSysVar:
+		if !ch.has(v) {
+			// not exposed, so we aren't keeping track
+			return globalValue(v)
+		}
+	}
+	return ch.vars[v]
+}
+
+// sets constraints and schema for v, if there are any
+func (ch *channel) limit(v identifier, c *constraints, s *schema) {
+	if !c.empty() {
+		ch.limits[v] = c
+	}
+	if s != nil {
+		ch.schemas[v] = s
+	}
+}
+
+// checks an incoming value against v's type, constraints and schema
+// returns the value the way we want to store it
+func (ch *channel) accept(v identifier, value interface{}) (interface{}, *errorMessage) {
+	value, ok := ch.types[v].normalize(value)
+	if !ok {
+		return nil, channelError(ch, v, "wrong type")
+	}
+	if msg := ch.limits[v].check(value); msg != "" {
+		return nil, channelError(ch, v, msg)
+	}
+	value, msg := ch.schemas[v].conform(value)
+	if msg != "" {
+		return nil, channelError(ch, v, msg)
+	}
+	return value, nil
+}
+
+// starting value of a user var for a new user
+func (ch *channel) defaultValue(v identifier, c *client) interface{} {
+	val := ch.defaults[v]
+	if str, ok := val.(string); ok {
+		return expandDefault(str, ch.joins, c.id, ch.name)
+	}
+	return val
+}
+
+// swaps out params that point to vars with their current values
+func (ch *channel) resolve(params map[string]interface{}, vars map[string]identifier) map[string]interface{} {
+	resolved := make(map[string]interface{}, len(params))
+	for k, p := range params {
+		if v, ok := vars[k]; ok {
+			p = ch.peek(v)
+		}
+		resolved[k] = p
+	}
+	return resolved
+}
+
 // gets all values from a collection (uservars)
 func (ch *channel) values(v identifier) (val map[*client]interface{}, err *errorMessage) {
 	if !ch.has(v) {
@@ -170,32 +520,61 @@ func (ch *channel) setVar(from, to *client, v identifier, value interface{}, ove
 			err := channelError(ch, v, "can't set that")
 			return err
 		}
+		if !ch.hasUser(from) {
+			err := channelError(ch, v, "not in this channel")
+			return err
+		}
+		if writers, restricted := ch.writers[v]; restricted && !from.matches(writers) {
+			err := channelError(ch, v, "not allowed")
+			return err
+		}
+	}
+
+	// did we get good data?
+	value, err := ch.accept(v, value)
+	if err != nil {
+		return err
 	}
 
 	switch v.kind {
 	case UserVar:
-		// did we get good data?
-		type_ := ch.types[v]
-		if type_.is(value) {
-			ch.uservars[v][to] = value
-			if to != from {
-				ch.notifyOne(to, v, value)
-			}
-			ch.invalidate(v)
-		} else {
-			if from != nil {
-				err := channelError(ch, v, "wrong type")
-				return err
-			}
+		if to == nil {
+			return channelError(ch, v, "whose var is that?")
+		}
+		ch.setUserValue(v, to, value)
+		if to != from {
+			ch.notifyOne(to, v, value)
+		}
+		if ch.public[v] {
+			ch.notifyPeers(to, v, value)
 		}
+		if ch.roster[v] {
+			ch.updateUsers()
+		}
+		ch.invalidate(v)
+	case BroadcastVar:
+		// don't spam everyone if nothing changed
+		if equal(ch.vars[v], value) {
+			return nil
+		}
+		ch.vars[v] = value
+		ch.notify(v, value)
+		if hasIdentifier(ch.shared, v) {
+			ch.publishRoom()
+		}
+		ch.invalidate(v)
 	case ChannelVar:
-		// TODO
+		if equal(ch.vars[v], value) {
+			return nil
+		}
+		ch.vars[v] = value
+		ch.notify(v, value)
+		if hasIdentifier(ch.shared, v) {
+			ch.publishRoom()
+		}
+		ch.invalidate(v)
 	case WireVar:
 		w := ch.wires[v]
-		if !w.inputType.is(value) {
-			err := channelError(ch, v, "wrong type")
-			return err
-		}
 		msg := value
 		if w.rewrite {
 			msg = w.transform(ch, w, to, msg)
@@ -203,7 +582,7 @@ func (ch *channel) setVar(from, to *client, v identifier, value interface{}, ove
 		if overwrite != nil {
 			if m, ok := msg.(map[string]interface{}); ok {
 				for k, v := range overwrite {
-					m[k] = v
+					m[k] = plainNumbers(v)
 				}
 			}
 		}
@@ -215,24 +594,65 @@ func (ch *channel) setVar(from, to *client, v identifier, value interface{}, ove
 func (ch *channel) run() {
 	log.Printf("Running channel: %s", ch.name)
 	defer unregisterChannel(ch)
+	if ch.globals {
+		subscribeGlobals(ch)
+		defer unsubscribeGlobals(ch)
+	}
+	if ch.lobby != 0 {
+		watchRooms(ch, ch.lobby)
+		defer unwatchRooms(ch, ch.lobby)
+		ch.refreshRooms()
+	}
+	if len(ch.cross) > 0 {
+		watchAggregates(ch, ch.watching)
+		defer unwatchAggregates(ch)
+	}
+	// some magic reads things that already have values, like @vars with defaults
+	for _, v := range ch.order {
+		ch.recompute(v)
+	}
+	defer func() {
+		if ch.alarm != nil {
+			ch.alarm.Stop()
+		}
+	}()
 
 	for {
+		ch.setAlarm()
 		select {
 		case c := <-ch.join:
 			ch.listeners[c] = true
+			ch.joined[c] = time.Now()
 
 			// welcome!
-			// TODO: rejection
+			// restricted channels turn people away before this, see canJoin
 			c.send(joinPartRequest{
 				Cmd:     "j",
 				Channel: ch.name,
 			})
 
 			// new guy joined so we gotta set up his vars
+			ch.joins++
+			changed := []identifier{listenersSysVar}
 			for name, values := range ch.uservars {
-				// TODO: some kind of default value setting, not just zero?
-				values[c] = ch.types[name].zero()
-				ch.invalidate(name)
+				ch.setUserValue(name, c, ch.defaultValue(name, c))
+				if ch.public[name] {
+					// everyone else just needs the new guy, but he needs everyone
+					ch.broadcastExcept(c, peerMessage{
+						Cmd:     "u",
+						Channel: ch.name,
+						Var:     name,
+						User:    c.id,
+						Value:   values[c],
+					})
+					c.send(peerMessage{
+						Cmd:     "U",
+						Channel: ch.name,
+						Var:     name,
+						Value:   values.snapshot(),
+					})
+				}
+				changed = append(changed, name)
 			}
 
 			// $listeners
@@ -241,16 +661,41 @@ func (ch *channel) run() {
 				ch.vars[listenersSysVar] = ct
 				ch.notify(listenersSysVar, ct)
 			}
+			// all at once, so magic reading a few of these only runs once
+			ch.invalidate(changed...)
+
+			// per-viewer magic the new guy's vars didn't already cover
+			for v, prep := range ch.viewerMagic {
+				if _, seen := ch.viewerCache[v][c]; !seen {
+					ch.recomputeFor(c, v, prep())
+				}
+			}
+			ch.updateUsers()
+			ch.publishRoom()
 		case c := <-ch.part:
 			delete(ch.listeners, c)
+			delete(ch.joined, c)
 
 			// goodbye, var cleanup
+			changed := []identifier{listenersSysVar}
 			for name, values := range ch.uservars {
 				if _, exists := values[c]; exists {
-					delete(values, c)
-					ch.invalidate(name)
+					ch.dropUserValue(name, c)
+					if ch.public[name] {
+						ch.broadcast(peerMessage{
+							Cmd:     "u",
+							Channel: ch.name,
+							Var:     name,
+							User:    c.id,
+							Gone:    true,
+						})
+					}
+					changed = append(changed, name)
 				}
 			}
+			for _, cache := range ch.viewerCache {
+				delete(cache, c)
+			}
 
 			// update $listeners
 			ct := len(ch.listeners)
@@ -258,6 +703,9 @@ func (ch *channel) run() {
 				ch.vars[listenersSysVar] = ct
 				ch.notify(listenersSysVar, ct)
 			}
+			ch.invalidate(changed...)
+			ch.updateUsers()
+			ch.publishRoom()
 
 			// die?
 			if ct == 0 {
@@ -297,6 +745,13 @@ func (ch *channel) run() {
 				}
 				o.to <- d
 			}
+		case <-ch.wake:
+			ch.alarm, ch.alarmAt, ch.wake = nil, time.Time{}, nil
+			ch.flushPaced()
+		case <-ch.poke:
+			ch.refreshGlobals()
+			ch.refreshRooms()
+			ch.refreshCross()
 		case set := <-ch.set:
 			err := ch.setVar(set.From, set.For, set.Var, set.Value, set.Overwrite)
 			if err != nil {
@@ -310,6 +765,10 @@ func (ch *channel) run() {
 type broadcast struct {
 	Type     jsType
 	ReadOnly bool
+	Default  interface{}
+	Restrict []string // roles or keys allowed to set this
+	Schema   *schema
+	constraints
 }
 
 type wire struct {
@@ -343,16 +802,51 @@ type goods struct {
 	err   *errorMessage
 }
 
+// an entry in $users
+type presence struct {
+	ID     clientID               `json:"id"`
+	Joined int64                  `json:"joined"` // unix time in ms
+	Vars   map[string]interface{} `json:"vars,omitempty"`
+}
+
+// same fields as the JSON
+func (p presence) object() map[string]interface{} {
+	obj := map[string]interface{}{
+		"id":     string(p.ID),
+		"joined": int(p.Joined),
+	}
+	if len(p.Vars) > 0 {
+		obj["vars"] = p.Vars
+	}
+	return obj
+}
+
+type byJoinTime []presence
+
+func (p byJoinTime) Len() int      { return len(p) }
+func (p byJoinTime) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byJoinTime) Less(i, j int) bool {
+	if p[i].Joined == p[j].Joined {
+		return p[i].ID < p[j].ID
+	}
+	return p[i].Joined < p[j].Joined
+}
+
 type uservarMap map[*client]interface{}
 
 //wouldn't it be cool if json.Marshal used .String() (or encoding.TextMarshaler!) so I didn't have to do this?
 func (m uservarMap) MarshalJSON() (b []byte, err error) {
-	idMap := make(map[string]interface{})
+	b, err = json.Marshal(m.snapshot())
+	return
+}
+
+// copy keyed by client ID, safe to hand to other goroutines
+func (m uservarMap) snapshot() map[string]interface{} {
+	idMap := make(map[string]interface{}, len(m))
 	for c, v := range m {
 		idMap[string(c.id)] = v
 	}
-	b, err = json.Marshal(idMap)
-	return
+	return idMap
 }
 
 func registerChannel(ch *channel) {
@@ -363,6 +857,10 @@ func registerChannel(ch *channel) {
 		panic("Remaking channel: " + ch.name)
 	}
 	channelTable[ch.name] = ch
+	atomic.AddInt64(&channelCount, 1)
+	if ch.listed {
+		listRoom(ch.roomInfo(), ch.prefix)
+	}
 
 	go ch.run()
 }
@@ -375,6 +873,13 @@ func unregisterChannel(ch *channel) {
 		panic("Deleting non-existent channel: " + ch.name)
 	}
 	delete(channelTable, ch.name)
+	atomic.AddInt64(&channelCount, -1)
+	if ch.listed {
+		unlistRoom(ch.name, ch.prefix)
+	}
+	if len(ch.aggregated) > 0 {
+		dropAggregate(ch.name)
+	}
 }
 
 func channelExists(name string) bool {
@@ -399,6 +904,16 @@ func getChannel(name string) *channel {
 	return ch
 }
 
+// checks restrictions before a join so rejected clients never spawn a channel
+func canJoin(c *client, name string) bool {
+	prefix, _ := utf8.DecodeRuneInString(name)
+	tmpl, exists := templates[prefix]
+	if !exists {
+		return true // getChannel will complain
+	}
+	return tmpl.allows(c)
+}
+
 func channelError(ch *channel, v identifier, msg string) *errorMessage {
 	return &errorMessage{
 		Cmd:     "!",
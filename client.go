@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"sync"
+	"sync/atomic"
 
 	"code.google.com/p/go.net/websocket"
 )
@@ -23,6 +24,7 @@ type client struct {
 	id        clientID
 	socket    *websocket.Conn
 	listening map[string]*channel
+	ident     *identity // nil until logged in
 
 	sendq chan interface{}
 }
@@ -50,9 +52,63 @@ func (c *client) sendMaybe(msg interface{}) {
 	}
 }
 
-func (c *client) setID(id clientID) {
-	renameClient(c.id, id)
+func (c *client) setID(id clientID) bool {
+	if !renameClient(c.id, id) {
+		return false
+	}
 	c.id = id
+	return true
+}
+
+func (c *client) loggedIn() bool {
+	return c.ident != nil
+}
+
+func (c *client) hasRole(role string) bool {
+	return c.ident != nil && c.ident.hasRole(role)
+}
+
+// does this client have any of these roles or login keys?
+func (c *client) matches(list []string) bool {
+	if !c.loggedIn() {
+		return false
+	}
+	for _, r := range list {
+		if c.ident.hasRole(r) || c.ident.key == r {
+			return true
+		}
+	}
+	return false
+}
+
+// log in with a key, taking on the identity it belongs to
+func (c *client) login(key string) {
+	if c.loggedIn() {
+		c.send(Error("l", "already logged in"))
+		return
+	}
+	// our ID is baked into every channel we're in, so it can't change after joining
+	if len(c.listening) > 0 {
+		c.send(Error("l", "log in before joining channels"))
+		return
+	}
+	ident, ok := currentAuth.authenticate(key)
+	if !ok {
+		c.send(Error("l", "bad key"))
+		return
+	}
+	if !c.setID(ident.id) {
+		c.send(Error("l", "already connected somewhere else"))
+		return
+	}
+	c.ident = &ident
+
+	log.Printf("Login: %s", c.id)
+	c.send(loginReply{
+		Cmd:   "l",
+		ID:    c.id,
+		Roles: ident.roles,
+	})
 }
 
 func (c *client) writer() {
@@ -87,14 +143,29 @@ func (c *client) run() {
 			continue
 		}
 
-		log.Printf("Got: %s\n-> %s\n", req.Cmd, string(data))
+		if req.Cmd == "l" {
+			// don't put keys in the log
+			log.Printf("Got: %s\n", req.Cmd)
+		} else {
+			log.Printf("Got: %s\n-> %s\n", req.Cmd, string(data))
+		}
 
 		switch req.Cmd {
+		case "l": //login
+			var lr loginRequest
+			json.Unmarshal(data, &lr)
+			c.login(lr.Key)
 		case "j": //join
 			fallthrough
 		case "p": //part
 			var jpr joinPartRequest
 			json.Unmarshal(data, &jpr)
+			if jpr.Cmd == "j" && !canJoin(c, jpr.Channel) {
+				err := Error(jpr.Cmd, "not allowed")
+				err.Channel = jpr.Channel
+				c.send(err)
+				continue
+			}
 			ch := getChannel(jpr.Channel)
 			if ch != nil {
 				if jpr.Cmd == "j" {
@@ -112,6 +183,13 @@ func (c *client) run() {
 		case "g": //get
 			var gr getRequest
 			json.Unmarshal(data, &gr)
+			// restricted channels are hidden from outsiders too
+			if !canJoin(c, gr.Channel) {
+				err := Error(gr.Cmd, "not allowed")
+				err.Channel = gr.Channel
+				c.send(err)
+				continue
+			}
 			ch := getChannel(gr.Channel)
 			if ch != nil {
 				get := getter{
@@ -125,6 +203,12 @@ func (c *client) run() {
 		case "G": //multi-get
 			var gr multigetRequest
 			json.Unmarshal(data, &gr)
+			if !canJoin(c, gr.Channel) {
+				err := Error(gr.Cmd, "not allowed")
+				err.Channel = gr.Channel
+				c.send(err)
+				continue
+			}
 			ch := getChannel(gr.Channel)
 			if ch != nil {
 				for _, v := range gr.Vars {
@@ -139,7 +223,7 @@ func (c *client) run() {
 			}
 		case "s": //set
 			var sr setRequest
-			json.Unmarshal(data, &sr)
+			decode(data, &sr)
 			ch := getChannel(sr.Channel)
 			if ch != nil {
 				set := setter{
@@ -154,7 +238,7 @@ func (c *client) run() {
 			}
 		case "S": //multi-set
 			var sr multisetRequest
-			json.Unmarshal(data, &sr)
+			decode(data, &sr)
 			ch := getChannel(sr.Channel)
 			if ch != nil {
 				for n, v := range sr.Values {
@@ -196,6 +280,7 @@ func addClient(c *client) {
 	defer clientsTableLock.Unlock()
 
 	clientsTable[c.id] = c
+	atomic.AddInt64(&clientCount, 1)
 }
 
 func getClient(id clientID) *client {
@@ -209,16 +294,24 @@ func removeClient(id clientID) {
 	clientsTableLock.Lock()
 	defer clientsTableLock.Unlock()
 
-	delete(clientsTable, id)
+	if _, exists := clientsTable[id]; exists {
+		delete(clientsTable, id)
+		atomic.AddInt64(&clientCount, -1)
+	}
 }
 
-func renameClient(old clientID, newVal clientID) {
+// returns false if the new ID is taken
+func renameClient(old clientID, newVal clientID) bool {
 	clientsTableLock.Lock()
 	defer clientsTableLock.Unlock()
 
+	if _, taken := clientsTable[newVal]; taken {
+		return false
+	}
 	c := clientsTable[old]
 	delete(clientsTable, old)
 	clientsTable[newVal] = c
+	return true
 }
 
 func generateID() clientID {
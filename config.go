@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
@@ -13,18 +15,21 @@ type config struct {
 	Static   staticConfig
 	Channels []channelTemplate `toml:"channel"`
 	API      apiConfig
+	Logins   []loginDef `toml:"login"`
 }
 
 type serverConfig struct {
 	Name string
 	Bind string
 	Path string
+	Tick string // how often server-wide vars like $time update
 }
 
 var defaultServerConfig = serverConfig{
 	Name: "Hakobiya",
 	Bind: ":8080",
 	Path: "/hakobiya",
+	Tick: "1s",
 }
 
 type staticConfig struct {
@@ -43,6 +48,12 @@ var defaultAPIConfig = apiConfig{
 	Path: "/api",
 }
 
+type loginDef struct {
+	Key   string
+	ID    string
+	Roles []string
+}
+
 func parseConfig(file string) (cfg config, ok bool) {
 	_, err := toml.DecodeFile(file, &cfg)
 	if err != nil {
@@ -76,6 +87,9 @@ func (cfg *config) prepare() {
 	} else {
 		cfg.Server.Path = fixPath(cfg.Server.Path)
 	}
+	if cfg.Server.Tick == "" {
+		cfg.Server.Tick = defaultServerConfig.Tick
+	}
 
 	// [api]
 	if cfg.API.Path == "" {
@@ -86,6 +100,31 @@ func (cfg *config) prepare() {
 
 	// [[channel]]
 	for _, ch := range cfg.Channels {
+		// value constraints and schemas
+		for _, v := range ch.Vars {
+			v.compile(v.Type)
+			if v.Schema != nil {
+				v.Schema.compile(v.Type)
+			}
+		}
+		for _, b := range ch.Broadcast {
+			b.compile(b.Type)
+			if b.Schema != nil {
+				b.Schema.compile(b.Type)
+			}
+		}
+		for _, c := range ch.Chan {
+			c.compile(c.Type)
+			if c.Schema != nil {
+				c.Schema.compile(c.Type)
+			}
+		}
+		for _, w := range ch.Wire {
+			w.compile(w.Type)
+			if w.Schema != nil {
+				w.Schema.compile(w.Type)
+			}
+		}
 		// [channel.wire.*]
 		for _, w := range ch.Wire {
 			if w.hasRewrite() {
@@ -93,9 +132,7 @@ func (cfg *config) prepare() {
 				// it can't handle map[string]identifier so we have to do this
 				w.Rewrite = make(rewriteDef)
 				for n, str := range w.RewriteStrings {
-					v := identifier{}
-					v.UnmarshalText([]byte(str))
-					w.Rewrite[n] = v
+					w.Rewrite[n] = parseRewriteRule(str)
 				}
 			}
 		}
@@ -113,11 +150,88 @@ func (cfg *config) prepare() {
 				}
 				m.Params["value"] = m.Param
 			}
+			// TOML gives us int64s, but we compare against ints
+			for k, p := range m.Params {
+				m.Params[k] = plainNumbers(p)
+			}
+			// params pointing at vars, and 'escaped strings that only look like they do
+			for k, p := range m.Params {
+				if v, ok := paramRef(p); ok {
+					if m.vars == nil {
+						m.vars = make(map[string]identifier)
+					}
+					m.vars[k] = v
+				} else if str, ok := p.(string); ok && strings.HasPrefix(str, "'") {
+					m.Params[k] = str[1:]
+				}
+			}
+			// value expression
+			if m.Value != "" {
+				e, err := parseExpr(m.Value)
+				if err != nil {
+					m.errs = append(m.errs, "value: "+err.Error())
+				}
+				m.expr = e
+			}
+			// where clause
+			if m.Where != "" {
+				cond, err := parseCondition(m.Where)
+				if err != nil {
+					m.errs = append(m.errs, "where: "+err.Error())
+				} else if t, ok := cfg.userVarType(ch, m, cond.v); !ok {
+					m.errs = append(m.errs, fmt.Sprintf("where: %s is not defined, did you forget [channel.var.%s]?", cond.v, cond.v.name))
+				} else if err := cond.compile(t); err != nil {
+					m.errs = append(m.errs, "where: "+err.Error())
+				} else {
+					m.cond = cond
+				}
+			}
+			// throttle and debounce
+			var msg string
+			if m.throttle, msg = parsePace("throttle", m.Throttle); msg != "" {
+				m.errs = append(m.errs, msg)
+			}
+			if m.debounce, msg = parsePace("debounce", m.Debounce); msg != "" {
+				m.errs = append(m.errs, msg)
+			}
+			// group and label
+			for opt, v := range m.inputs() {
+				if v.kind != UserVar {
+					m.errs = append(m.errs, fmt.Sprintf("%s: %s should be a user var (%%)", opt, v))
+				} else if _, ok := cfg.userVarType(ch, m, v); !ok {
+					m.errs = append(m.errs, fmt.Sprintf("%s: %s is not defined, did you forget [channel.var.%s]?", opt, v, v.name))
+				}
+			}
+		}
+		// magic built on magic needs the other magic's type, which we can't figure out if there are cycles
+		// config.check will complain about those
+		if _, cycle := ch.magicOrder(); cycle == nil {
+			tmpls := cfg.byPrefix()
+			for _, m := range ch.Magic {
+				srcType := ch.magicSrcType(m, tmpls)
+				// the comparison value should look like the source values
+				if cmp, ok := m.Params["value"]; ok && srcType.valid() && srcType != jsAnything {
+					if norm, ok := srcType.normalize(cmp); ok {
+						m.Params["value"] = norm
+					}
+				}
+				// per-viewer magic makes a value for each user, so it can't be grouped too
+				if m.grouped() && isViewerMagic(spell{srcType, m.Func}) {
+					m.errs = append(m.errs, fmt.Sprintf("group: %s gives each user their own value, so it can't be grouped", m.Func))
+				}
+			}
 		}
 	}
 }
 
 func (cfg config) check() (ok bool, errors []string) {
+	// server stuff
+	if tick, err := time.ParseDuration(cfg.Server.Tick); err != nil {
+		errors = append(errors, fmt.Sprintf("[server] tick: %s", err))
+	} else if tick <= 0 {
+		errors = append(errors, "[server] tick should be more than zero, like \"1s\"")
+	}
+
 	// static server stuff
 	if cfg.Static.Enabled {
 		if cfg.Static.Index == "" && len(cfg.Static.Dirs) == 0 {
@@ -145,6 +259,35 @@ func (cfg config) check() (ok bool, errors []string) {
 		}
 	}
 
+	// logins
+	keyMap := make(map[string]bool)
+	idMap := make(map[string]bool)
+	roleMap := make(map[string]bool)
+	for n, l := range cfg.Logins {
+		if l.Key == "" {
+			errors = append(errors, fmt.Sprintf("[[login]] #%d: No 'key' set!", n+1))
+		} else {
+			if _, exists := keyMap[l.Key]; exists {
+				errors = append(errors, fmt.Sprintf("[[login]] #%d: Duplicate key", n+1))
+			}
+			keyMap[l.Key] = true
+		}
+		if l.ID == "" {
+			errors = append(errors, fmt.Sprintf("[[login]] #%d: No 'id' set!", n+1))
+		} else {
+			if strings.HasPrefix(l.ID, "_") {
+				errors = append(errors, fmt.Sprintf("[[login]] #%d: id '%s' can't start with _ (reserved for guests)", n+1, l.ID))
+			}
+			if _, exists := idMap[l.ID]; exists {
+				errors = append(errors, fmt.Sprintf("[[login]] #%d: Duplicate id: %s", n+1, l.ID))
+			}
+			idMap[l.ID] = true
+		}
+		for _, r := range l.Roles {
+			roleMap[r] = true
+		}
+	}
+
 	// channel stuff
 	channelMap := make(map[string]bool)
 
@@ -163,53 +306,169 @@ func (cfg config) check() (ok bool, errors []string) {
 				channelMap[ch.Prefix] = true
 			}
 		}
+		// restrict
+		for _, r := range ch.Restrict {
+			if !roleMap[r] && !keyMap[r] {
+				errors = append(errors, fmt.Sprintf("(%s) [channel] restrict: no login has the role or key '%s'", ch.Prefix, r))
+			}
+		}
 		// expose
+		exposed := make(map[identifier]bool)
 		for _, v := range ch.Expose {
 			if v.kind != SystemVar {
 				errors = append(errors, fmt.Sprintf("(%s) [channel.expose] Not a system variable: %s", ch.Prefix, v))
+			} else if !exposable[v] {
+				errors = append(errors, fmt.Sprintf("(%s) [channel.expose] Unknown system variable: %s", ch.Prefix, v))
+			}
+			exposed[v] = true
+		}
+		// $rooms
+		if ch.Rooms != nil {
+			if !exposed[roomsSysVar] {
+				errors = append(errors, fmt.Sprintf("(%s) [channel.rooms] is set but $rooms isn't exposed", ch.Prefix))
+			}
+			var listed *channelTemplate
+			for i := range cfg.Channels {
+				if cfg.Channels[i].Prefix == ch.Rooms.Prefix {
+					listed = &cfg.Channels[i]
+				}
+			}
+			if listed == nil {
+				errors = append(errors, fmt.Sprintf("(%s) [channel.rooms] prefix: no [[channel]] with prefix '%s'", ch.Prefix, ch.Rooms.Prefix))
+			} else {
+				for _, v := range ch.Rooms.Vars {
+					if (v.kind != ChannelVar && v.kind != BroadcastVar) || !listed.defines(v) {
+						errors = append(errors, fmt.Sprintf("(%s) [channel.rooms] vars: %s isn't a channel or broadcast variable of (%s)", ch.Prefix, v, listed.Prefix))
+					}
+				}
+			}
+		} else if exposed[roomsSysVar] {
+			errors = append(errors, fmt.Sprintf("(%s) [channel.expose] $rooms needs a [channel.rooms] table to know what to list", ch.Prefix))
+		}
+		// $users
+		if len(ch.Users) > 0 && !exposed[usersSysVar] {
+			errors = append(errors, fmt.Sprintf("(%s) [channel] users is set but $users isn't exposed", ch.Prefix))
+		}
+		for _, v := range ch.Users {
+			if v.kind != UserVar || ch.Vars[v.name] == nil {
+				errors = append(errors, fmt.Sprintf("(%s) [channel] users: %s is not a user variable, did you forget [channel.var.%s]?", ch.Prefix, v, v.name))
+			} else if !ch.Vars[v.name].Public {
+				errors = append(errors, fmt.Sprintf("(%s) [channel] users: %s needs to be public", ch.Prefix, v))
 			}
 		}
 		// broadcast check
 		for name, b := range ch.Broadcast {
-			if !b.Type.valid() {
-				errors = append(errors, fmt.Sprintf("(%s) [channel.broadcast.%s] Invalid type: %s", ch.Prefix, name, b.Type))
+			where := fmt.Sprintf("(%s) [channel.broadcast.%s]", ch.Prefix, name)
+			errors = append(errors, checkValueDef(where, b.Type, b.Default, &b.constraints, b.Schema)...)
+			for _, r := range b.Restrict {
+				if !roleMap[r] && !keyMap[r] {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.broadcast.%s] restrict: no login has the role or key '%s'", ch.Prefix, name, r))
+				}
+			}
+		}
+		// channel var check
+		for name, c := range ch.Chan {
+			where := fmt.Sprintf("(%s) [channel.chan.%s]", ch.Prefix, name)
+			errors = append(errors, checkValueDef(where, c.Type, c.Default, &c.constraints, c.Schema)...)
+			for _, r := range c.Restrict {
+				if !roleMap[r] && !keyMap[r] {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.chan.%s] restrict: no login has the role or key '%s'", ch.Prefix, name, r))
+				}
 			}
 		}
 		// uservar check
 		for name, v := range ch.Vars {
-			if !v.Type.valid() {
-				errors = append(errors, fmt.Sprintf("(%s) [channel.var.%s] Invalid type: %s", ch.Prefix, name, v.Type))
+			where := fmt.Sprintf("(%s) [channel.var.%s]", ch.Prefix, name)
+			def := v.Default
+			if str, ok := def.(string); ok {
+				if bad := badDefaultVerb(str); bad != "" {
+					errors = append(errors, fmt.Sprintf("%s Unknown %s in default, try %%d, %%u, %%c or %%%%", where, bad))
+				}
+				// check what a guest would actually get
+				def = expandDefault(str, 1, generateID(), ch.Prefix+"test")
 			}
+			errors = append(errors, checkValueDef(where, v.Type, def, &v.constraints, v.Schema)...)
 		}
 		// magic check
+		tmpls := cfg.byPrefix()
+		_, cycle := ch.magicOrder()
+		if cycle != nil {
+			errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Magic can't depend on itself: &%s",
+				ch.Prefix, cycle[0], strings.Join(cycle, " → &")))
+		}
 		for name, m := range ch.Magic {
-			if m.Func == "" {
+			for _, e := range m.errs {
+				errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] %s", ch.Prefix, name, e))
+			}
+			if m.Throttle != "" && m.Debounce != "" {
+				errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Use either throttle or debounce, not both", ch.Prefix, name))
+			}
+			if m.Value != "" {
+				if m.Func != "" || m.Src.name != "" || m.cross() || m.Where != "" || len(m.inputs()) > 0 {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Use either value or src and func, not both",
+						ch.Prefix, name))
+				}
+				if m.expr != nil && cycle == nil {
+					if _, err := m.expr.check(ch.exprTypes(tmpls)); err != nil {
+						errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] value: %s", ch.Prefix, name, err))
+					}
+				}
+			} else if m.Func == "" {
 				errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Missing 'func' magic function definition!", ch.Prefix, name))
+			} else if m.cross() {
+				errors = append(errors, cfg.checkCross(ch, name, m)...)
 			} else {
-				if !ch.defines(m.Src) {
-					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Source variable %s is not defined, did you forget [channel.var.%s]?",
-						ch.Prefix, name, m.Src, m.Src.name))
-				} else {
-					srcVar := ch.Vars[m.Src.name]
-					if srcVar.Type.valid() {
-						sig := spell{srcVar.Type, m.Func}
+				if msg := ch.checkMagicInput(m.Src); msg != "" {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Source variable %s", ch.Prefix, name, msg))
+				} else if cycle == nil {
+					if ch.perViewer(m.Src, tmpls) {
+						errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Source variable %s is different for every user, other magic can't read it",
+							ch.Prefix, name, m.Src))
+					}
+					if t := ch.varType(m.Src, tmpls); t.valid() {
+						sig := spell{t, m.Func}
 						if !hasMagic(sig) {
 							errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] No such magic spell: %s", ch.Prefix, name, sig))
 						}
 					}
 				}
+				if m.Src.kind != UserVar && (m.cond != nil || len(m.inputs()) > 0) {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] where, group and label only work when src is a user var",
+						ch.Prefix, name))
+				}
+			}
+			for _, ref := range m.refs() {
+				if msg := ch.checkMagicInput(ref); msg != "" {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Param %s", ch.Prefix, name, msg))
+				} else if cycle == nil && ch.perViewer(ref, tmpls) {
+					errors = append(errors, fmt.Sprintf("(%s) [channel.magic.%s] Param %s is different for every user, other magic can't read it",
+						ch.Prefix, name, ref))
+				}
 			}
 		}
 		// wire check
 		for name, w := range ch.Wire {
 			if !w.Type.valid() {
 				errors = append(errors, fmt.Sprintf("(%s) [channel.wire.%s.input] Invalid type: %s", ch.Prefix, name, string(w.Type)))
+			} else {
+				where := fmt.Sprintf("(%s) [channel.wire.%s]", ch.Prefix, name)
+				errors = append(errors, checkValueDef(where, w.Type, nil, &w.constraints, w.Schema)...)
 			}
 			if w.hasRewrite() {
-				for n, v := range w.Rewrite {
-					if v.kind != LiteralString && !ch.defines(v) {
+				for n, rule := range w.Rewrite {
+					switch {
+					case rule.err != nil:
+						errors = append(errors, fmt.Sprintf("(%s) [channel.wire.%s.rewrite] %s: %s", ch.Prefix, name, n, rule.err))
+					case rule.expr != nil:
+						if cycle != nil {
+							break
+						}
+						if _, err := rule.expr.check(ch.rewriteTypes(w, tmpls)); err != nil {
+							errors = append(errors, fmt.Sprintf("(%s) [channel.wire.%s.rewrite] %s: %s", ch.Prefix, name, n, err))
+						}
+					case rule.v.kind != LiteralString && !ch.defines(rule.v):
 						errors = append(errors, fmt.Sprintf("(%s) [channel.wire.%s.output.rewrite] %s = %s, no such var: %s",
-							ch.Prefix, name, n, v, v))
+							ch.Prefix, name, n, rule.v, rule.v))
 					}
 				}
 			}
@@ -221,6 +480,169 @@ func (cfg config) check() (ok bool, errors []string) {
 	return
 }
 
+// cross-channel magic needs every channel it reads to have src as a user var of the same type
+func (cfg config) checkCross(ch channelTemplate, name string, m *magicDef) (errors []string) {
+	where := fmt.Sprintf("(%s) [channel.magic.%s]", ch.Prefix, name)
+	if m.Across != "" && len(m.Channels) > 0 {
+		errors = append(errors, where+" Use either across or channels, not both")
+	}
+	if m.Across != "" && utf8.RuneCountInString(m.Across) != 1 {
+		errors = append(errors, fmt.Sprintf("%s across should be a single prefix character, not %q", where, m.Across))
+	}
+	if m.Src.kind != UserVar {
+		return append(errors, fmt.Sprintf("%s Source variable %s should be a user var (%%) to read it across channels", where, m.Src))
+	}
+
+	tmpls := cfg.byPrefix()
+	srcType := m.scope().srcType(tmpls, m.Src)
+	for _, prefix := range m.scope().prefixes() {
+		tmpl, exists := tmpls[prefix]
+		if !exists {
+			errors = append(errors, fmt.Sprintf("%s No channel with prefix %s to read from", where, string(prefix)))
+			continue
+		}
+		srcVar := tmpl.Vars[m.Src.name]
+		if srcVar == nil {
+			errors = append(errors, fmt.Sprintf("%s Source variable %s is not defined in (%s), did you forget [channel.var.%s]?",
+				where, m.Src, tmpl.Prefix, m.Src.name))
+		} else if srcVar.Type != srcType {
+			errors = append(errors, fmt.Sprintf("%s Source variable %s is %s in (%s), but %s elsewhere",
+				where, m.Src, srcVar.Type, tmpl.Prefix, srcType))
+		}
+	}
+	if srcType.valid() && srcType != jsAnything {
+		sig := spell{srcType, m.Func}
+		if !hasMagic(sig) {
+			errors = append(errors, fmt.Sprintf("%s No such magic spell: %s", where, sig))
+		}
+	}
+	return
+}
+
+// parses a throttle or debounce duration, giving back a problem if there is one
+func parsePace(opt, str string) (time.Duration, string) {
+	if str == "" {
+		return 0, ""
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Sprintf("%s: %s", opt, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Sprintf("%s should be more than zero, like \"100ms\"", opt)
+	}
+	return d, ""
+}
+
+// type of a user var a magic reads (for where or group), false if it's missing anywhere the magic reads
+func (cfg config) userVarType(ch channelTemplate, m *magicDef, v identifier) (jsType, bool) {
+	if !m.cross() {
+		def := ch.Vars[v.name]
+		if def == nil {
+			return jsNone, false
+		}
+		return def.Type, true
+	}
+	tmpls := cfg.byPrefix()
+	for _, prefix := range m.scope().prefixes() {
+		if tmpl, ok := tmpls[prefix]; !ok || tmpl.Vars[v.name] == nil {
+			return jsNone, false
+		}
+	}
+	return m.scope().srcType(tmpls, v), true
+}
+
+// what's wrong with magic reading v, or "" if it's fine
+func (tmpl channelTemplate) checkMagicInput(v identifier) string {
+	if !tmpl.defines(v) {
+		return fmt.Sprintf("%s is not defined, did you forget %s?", v, definedIn(v))
+	}
+	switch v.kind {
+	case WireVar, LiteralString:
+		return fmt.Sprintf("%s can't be used in magic", v)
+	case SystemVar:
+		if _, ok := sysVarTypes[v]; !ok {
+			return fmt.Sprintf("%s can't be used in magic", v)
+		}
+		switch v {
+		case listenersSysVar, channelSysVar, serverSysVar:
+			// always around
+		default:
+			// we only keep track of these if they're exposed
+			if !hasIdentifier(tmpl.Expose, v) {
+				return fmt.Sprintf("%s isn't exposed, did you forget to add it to expose?", v)
+			}
+		}
+	}
+	return ""
+}
+
+// is v per-viewer magic? (don't call this if there are cycles)
+func (tmpl channelTemplate) perViewer(v identifier, all map[rune]channelTemplate) bool {
+	m := tmpl.Magic[v.name]
+	if v.kind != MagicVar || m == nil {
+		return false
+	}
+	return isViewerMagic(spell{tmpl.magicSrcType(m, all), m.Func})
+}
+
+// where you'd define v, for error messages
+func definedIn(v identifier) string {
+	switch v.kind {
+	case UserVar:
+		return "[channel.var." + v.name + "]"
+	case MagicVar:
+		return "[channel.magic." + v.name + "]"
+	case BroadcastVar:
+		return "[channel.broadcast." + v.name + "]"
+	case ChannelVar:
+		return "[channel.chan." + v.name + "]"
+	case WireVar:
+		return "[channel.wire." + v.name + "]"
+	}
+	return "to add it to expose"
+}
+
+// channel templates by prefix
+func (cfg config) byPrefix() map[rune]channelTemplate {
+	tmpls := make(map[rune]channelTemplate, len(cfg.Channels))
+	for _, ch := range cfg.Channels {
+		prefix, _ := utf8.DecodeRuneInString(ch.Prefix)
+		tmpls[prefix] = ch
+	}
+	return tmpls
+}
+
+// checks the type, default value, constraints and schema shared by var-like definitions
+func checkValueDef(where string, t jsType, def interface{}, c *constraints, s *schema) (errors []string) {
+	if !t.valid() {
+		return []string{fmt.Sprintf("%s Invalid type: %s", where, t)}
+	}
+	for _, e := range c.errs {
+		errors = append(errors, fmt.Sprintf("%s %s", where, e))
+	}
+	if s != nil {
+		for _, e := range s.errs {
+			errors = append(errors, fmt.Sprintf("%s %s", where, e))
+		}
+	}
+	if len(errors) > 0 {
+		// no point checking the default against broken rules
+		return
+	}
+	if def != nil {
+		val, ok := t.normalize(def)
+		if !ok {
+			errors = append(errors, fmt.Sprintf("%s Default value %v is not a %s", where, def, t))
+		} else if msg := c.check(val); msg != "" {
+			errors = append(errors, fmt.Sprintf("%s Default value %v breaks the rules: %s", where, def, msg))
+		} else if _, msg := s.conform(val); msg != "" {
+			errors = append(errors, fmt.Sprintf("%s Default value doesn't fit the schema: %s", where, msg))
+		}
+	}
+	return
+}
+
 func fixPath(path string) string {
 	if path[0] != '/' {
 		path = "/" + path
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"unicode/utf8"
+)
+
+// limits on the values a var or wire will take
+// for arrays, everything but maxitems applies to each element
+type constraints struct {
+	Min       interface{}   // numbers
+	Max       interface{}   // numbers
+	MaxLength int           // strings, in characters
+	Pattern   string        // strings must match this regexp
+	Enum      []interface{} // value must be one of these
+	MaxItems  int           // arrays
+	Required  []string      // keys objects must have
+
+	min, max *float64
+	re       *regexp.Regexp
+	errs     []string // config problems found by compile, reported by config.check
+}
+
+func (c constraints) empty() bool {
+	return c.Min == nil && c.Max == nil && c.MaxLength == 0 && c.Pattern == "" &&
+		len(c.Enum) == 0 && c.MaxItems == 0 && len(c.Required) == 0
+}
+
+// gets everything ready for checking values of type t
+func (c *constraints) compile(t jsType) {
+	c.errs = nil
+	elemType := t
+	if t.array() {
+		elemType = t.elem()
+	}
+
+	numeric := elemType == jsInt || elemType == jsFloat || elemType == jsAnything
+	if (c.Min != nil || c.Max != nil) && !numeric {
+		c.errs = append(c.errs, fmt.Sprintf("min and max only work on numbers, not %s", t))
+	}
+	if c.Min != nil {
+		if f, ok := toFloat(plainNumbers(c.Min)); ok {
+			c.min = &f
+		} else {
+			c.errs = append(c.errs, fmt.Sprintf("min should be a number, not %v", c.Min))
+		}
+	}
+	if c.Max != nil {
+		if f, ok := toFloat(plainNumbers(c.Max)); ok {
+			c.max = &f
+		} else {
+			c.errs = append(c.errs, fmt.Sprintf("max should be a number, not %v", c.Max))
+		}
+	}
+	if c.min != nil && c.max != nil && *c.min > *c.max {
+		c.errs = append(c.errs, fmt.Sprintf("min (%v) is bigger than max (%v)", *c.min, *c.max))
+	}
+
+	if (c.MaxLength != 0 || c.Pattern != "") && elemType != jsString && elemType != jsAnything {
+		c.errs = append(c.errs, fmt.Sprintf("maxlength and pattern only work on strings, not %s", t))
+	}
+	if c.Pattern != "" {
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			c.errs = append(c.errs, fmt.Sprintf("bad pattern: %s", err))
+		}
+		c.re = re
+	}
+
+	if c.MaxItems != 0 && !t.array() && t != jsAnything {
+		c.errs = append(c.errs, fmt.Sprintf("maxitems only works on arrays, not %s", t))
+	}
+	if len(c.Required) > 0 && elemType != jsObject && elemType != jsAnything {
+		c.errs = append(c.errs, fmt.Sprintf("required only works on objects, not %s", t))
+	}
+
+	for i, e := range c.Enum {
+		norm, ok := elemType.normalize(e)
+		if !ok {
+			c.errs = append(c.errs, fmt.Sprintf("enum value %v is not a %s", e, elemType))
+			continue
+		}
+		c.Enum[i] = norm
+	}
+}
+
+// returns what's wrong with v, or "" if it's OK
+func (c *constraints) check(v interface{}) string {
+	if c == nil {
+		return ""
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Slice {
+		if c.MaxItems > 0 && rv.Len() > c.MaxItems {
+			return fmt.Sprintf("too many items (max %d)", c.MaxItems)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if msg := c.checkOne(rv.Index(i).Interface()); msg != "" {
+				return msg
+			}
+		}
+		return ""
+	}
+	return c.checkOne(v)
+}
+
+func (c *constraints) checkOne(v interface{}) string {
+	if len(c.Enum) > 0 && !c.allowed(v) {
+		return "not an allowed value"
+	}
+	switch x := v.(type) {
+	case int:
+		return c.checkNumber(float64(x))
+	case float64:
+		return c.checkNumber(x)
+	case string:
+		if c.MaxLength > 0 && utf8.RuneCountInString(x) > c.MaxLength {
+			return fmt.Sprintf("too long (max %d characters)", c.MaxLength)
+		}
+		if c.re != nil && !c.re.MatchString(x) {
+			return "doesn't match the pattern"
+		}
+	case map[string]interface{}:
+		for _, k := range c.Required {
+			if _, exists := x[k]; !exists {
+				return "missing required key: " + k
+			}
+		}
+	}
+	return ""
+}
+
+func (c *constraints) checkNumber(n float64) string {
+	if c.min != nil && n < *c.min {
+		return fmt.Sprintf("too small (min %v)", *c.min)
+	}
+	if c.max != nil && n > *c.max {
+		return fmt.Sprintf("too big (max %v)", *c.max)
+	}
+	return ""
+}
+
+func (c *constraints) allowed(v interface{}) bool {
+	for _, e := range c.Enum {
+		if equal(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,890 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// a tiny expression language for magic values and wire rewrites, like
+//   value = "&sum / max($listeners, 1)"
+//   rewrite.msg = "upper(trim($input))"
+// expressions can only read vars and call the functions in exprFuncs, so there's nothing to escape from
+// config.check parses and type-checks everything, evaluating happens in the channel goroutine
+
+type expr struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	// works out the type this gives, or what's wrong
+	check(types typeLookup) (jsType, error)
+	eval(env valueLookup) (interface{}, error)
+}
+
+// how expressions find out about vars
+type typeLookup func(identifier) (jsType, error)
+type valueLookup func(identifier) interface{}
+
+func parseExpr(src string) (*expr, error) {
+	p := &exprParser{src: src}
+	p.next()
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &expr{src, root}, nil
+}
+
+func (e *expr) check(types typeLookup) (jsType, error) {
+	return e.root.check(types)
+}
+
+func (e *expr) eval(env valueLookup) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+// every var the expression reads
+func (e *expr) vars() []identifier {
+	var vars []identifier
+	var walk func(n exprNode)
+	walk = func(n exprNode) {
+		switch n := n.(type) {
+		case exprVar:
+			if !hasIdentifier(vars, n.v) {
+				vars = append(vars, n.v)
+			}
+		case exprUnary:
+			walk(n.x)
+		case exprBinary:
+			walk(n.l)
+			walk(n.r)
+		case exprTernary:
+			walk(n.cond)
+			walk(n.a)
+			walk(n.b)
+		case exprCall:
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(e.root)
+	return vars
+}
+
+// lexing
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNumber
+	tokString
+	tokVar
+	tokName
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	val  interface{} // for numbers and strings
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", ","}
+
+type exprParser struct {
+	src string
+	pos int
+	tok token
+	err error
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func isNameRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// reads the next token into p.tok
+func (p *exprParser) next() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return
+	}
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+
+	switch {
+	case r >= '0' && r <= '9':
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		text := p.src[start:p.pos]
+		if n, err := strconv.Atoi(text); err == nil {
+			p.tok = token{tokNumber, text, n, start}
+		} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+			p.tok = token{tokNumber, text, f, start}
+		} else {
+			p.tok = token{tokOp, text, nil, start} // the parser will complain
+		}
+	case r == '"' || r == '\'':
+		var str []byte
+		p.pos += size
+		for p.pos < len(p.src) && rune(p.src[p.pos]) != r {
+			c := p.src[p.pos]
+			if c == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+				switch p.src[p.pos] {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				default:
+					c = p.src[p.pos]
+				}
+			}
+			str = append(str, c)
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			p.tok = token{kind: tokOp, text: p.src[start:], pos: start}
+			p.err = fmt.Errorf("at %d: unfinished string", start+1)
+			return
+		}
+		p.pos++
+		p.tok = token{tokString, p.src[start:p.pos], string(str), start}
+	case p.startsVar(r, size):
+		p.pos += size
+		for p.pos < len(p.src) {
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			if !isNameRune(r) {
+				break
+			}
+			p.pos += size
+		}
+		p.tok = token{kind: tokVar, text: p.src[start:p.pos], pos: start}
+	case isNameRune(r):
+		for p.pos < len(p.src) {
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			if !isNameRune(r) {
+				break
+			}
+			p.pos += size
+		}
+		p.tok = token{kind: tokName, text: p.src[start:p.pos], pos: start}
+	default:
+		for _, op := range exprOps {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = token{kind: tokOp, text: op, pos: start}
+				return
+			}
+		}
+		p.pos += size
+		p.tok = token{kind: tokOp, text: string(r), pos: start}
+	}
+}
+
+// sigils are also operators (&&, %), so they only start a var if a name comes right after
+func (p *exprParser) startsVar(r rune, size int) bool {
+	if kind := sigilTable[r]; kind == InvalidVar || kind == LiteralString {
+		return false
+	}
+	// a digit means it's an operator, so &a%2 is &a % 2
+	next, _ := utf8.DecodeRuneInString(p.src[p.pos+size:])
+	return p.pos+size < len(p.src) && isNameRune(next) && !unicode.IsDigit(next)
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q, got %s", op, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+// parsing, from loosest to tightest
+
+func (p *exprParser) parseTernary() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	p.next()
+	a, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return exprTernary{cond, a, b}, nil
+}
+
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+	l, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(precedence[level]...) {
+		op := p.tok.text
+		p.next()
+		r, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l = exprBinary{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("-", "!") {
+		op := p.tok.text
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		p.next()
+		if _, ok := tok.val.(int); ok {
+			return exprLiteral{tok.val, jsInt}, nil
+		}
+		return exprLiteral{tok.val, jsFloat}, nil
+	case tokString:
+		p.next()
+		return exprLiteral{tok.val, jsString}, nil
+	case tokVar:
+		var v identifier
+		if err := v.UnmarshalText([]byte(tok.text)); err != nil {
+			return nil, p.errorf("bad var %s", tok)
+		}
+		p.next()
+		return exprVar{v}, nil
+	case tokName:
+		p.next()
+		switch tok.text {
+		case "true":
+			return exprLiteral{true, jsBool}, nil
+		case "false":
+			return exprLiteral{false, jsBool}, nil
+		}
+		if _, ok := exprFuncs[tok.text]; !ok {
+			return nil, fmt.Errorf("at %d: no such function: %s", tok.pos+1, tok.text)
+		}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var args []exprNode
+		for !p.isOp(")") {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.next()
+		return exprCall{tok.text, args}, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		x, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// the nodes
+
+type exprLiteral struct {
+	val   interface{}
+	type_ jsType
+}
+
+func (n exprLiteral) check(types typeLookup) (jsType, error) {
+	return n.type_, nil
+}
+
+func (n exprLiteral) eval(env valueLookup) (interface{}, error) {
+	return n.val, nil
+}
+
+type exprVar struct {
+	v identifier
+}
+
+func (n exprVar) check(types typeLookup) (jsType, error) {
+	return types(n.v)
+}
+
+func (n exprVar) eval(env valueLookup) (interface{}, error) {
+	return env(n.v), nil
+}
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+func (n exprUnary) check(types typeLookup) (jsType, error) {
+	t, err := n.x.check(types)
+	if err != nil {
+		return t, err
+	}
+	if n.op == "!" {
+		return jsBool, want(t, "!", jsBool)
+	}
+	return t, want(t, "-", jsInt, jsFloat)
+}
+
+func (n exprUnary) eval(env valueLookup) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! needs a bool, not %v", x)
+		}
+		return !b, nil
+	}
+	switch x := x.(type) {
+	case int:
+		return -x, nil
+	case float64:
+		return -x, nil
+	}
+	return nil, fmt.Errorf("- needs a number, not %v", x)
+}
+
+type exprBinary struct {
+	op   string
+	l, r exprNode
+}
+
+func (n exprBinary) check(types typeLookup) (jsType, error) {
+	lt, err := n.l.check(types)
+	if err != nil {
+		return lt, err
+	}
+	rt, err := n.r.check(types)
+	if err != nil {
+		return rt, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		if err := want(lt, n.op, jsBool); err != nil {
+			return jsBool, err
+		}
+		return jsBool, want(rt, n.op, jsBool)
+	case "==", "!=":
+		if lt != jsAnything && rt != jsAnything && lt != rt && !(isNumber(lt) && isNumber(rt)) {
+			return jsBool, fmt.Errorf("can't compare %s and %s", lt, rt)
+		}
+		return jsBool, nil
+	case "<", "<=", ">", ">=":
+		if err := want(lt, n.op, jsInt, jsFloat, jsString); err != nil {
+			return jsBool, err
+		}
+		if err := want(rt, n.op, jsInt, jsFloat, jsString); err != nil {
+			return jsBool, err
+		}
+		if (lt == jsString) != (rt == jsString) && lt != jsAnything && rt != jsAnything {
+			return jsBool, fmt.Errorf("can't compare %s and %s", lt, rt)
+		}
+		return jsBool, nil
+	case "+":
+		if lt == jsString || rt == jsString {
+			if err := want(lt, "+", jsString); err != nil {
+				return jsString, fmt.Errorf("can't add %s and %s, try str()", lt, rt)
+			}
+			return jsString, want(rt, "+", jsString)
+		}
+	case "%":
+		if err := want(lt, "%", jsInt); err != nil {
+			return jsInt, err
+		}
+		return jsInt, want(rt, "%", jsInt)
+	}
+
+	// arithmetic
+	if err := want(lt, n.op, jsInt, jsFloat); err != nil {
+		return jsFloat, err
+	}
+	if err := want(rt, n.op, jsInt, jsFloat); err != nil {
+		return jsFloat, err
+	}
+	switch {
+	case lt == jsAnything || rt == jsAnything:
+		return jsAnything, nil
+	case n.op == "/" || lt == jsFloat || rt == jsFloat:
+		return jsFloat, nil
+	}
+	return jsInt, nil
+}
+
+func (n exprBinary) eval(env valueLookup) (interface{}, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// don't bother with the right side if we already know
+	switch n.op {
+	case "&&", "||":
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs bools, not %v", n.op, l)
+		}
+		if lb == (n.op == "||") {
+			return lb, nil
+		}
+		r, err := n.r.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs bools, not %v", n.op, r)
+		}
+		return rb, nil
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(l, r), nil
+	case "!=":
+		return !exprEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		cmp, ok := compare(l, r)
+		if !ok {
+			return nil, fmt.Errorf("can't compare %v and %v", l, r)
+		}
+		switch n.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		}
+		return cmp >= 0, nil
+	case "+":
+		if ls, ok := l.(string); ok {
+			rs, ok := r.(string)
+			if !ok {
+				return nil, fmt.Errorf("can't add %v and %v", l, r)
+			}
+			return ls + rs, nil
+		}
+	}
+
+	li, lInt := l.(int)
+	ri, rInt := r.(int)
+	if lInt && rInt && n.op != "/" {
+		switch n.op {
+		case "+":
+			return li + ri, nil
+		case "-":
+			return li - ri, nil
+		case "*":
+			return li * ri, nil
+		case "%":
+			if ri == 0 {
+				return 0, nil
+			}
+			return li % ri, nil
+		}
+	}
+	lf, lok := toFloat(l)
+	rf, rok := toFloat(r)
+	if !lok || !rok || n.op == "%" {
+		return nil, fmt.Errorf("can't %s %v and %v", n.op, l, r)
+	}
+	switch n.op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	}
+	// dividing by zero gives 0, like the div spell
+	if rf == 0 {
+		return 0.0, nil
+	}
+	return lf / rf, nil
+}
+
+type exprTernary struct {
+	cond, a, b exprNode
+}
+
+func (n exprTernary) check(types typeLookup) (jsType, error) {
+	ct, err := n.cond.check(types)
+	if err != nil {
+		return ct, err
+	}
+	if err := want(ct, "?", jsBool); err != nil {
+		return ct, err
+	}
+	at, err := n.a.check(types)
+	if err != nil {
+		return at, err
+	}
+	bt, err := n.b.check(types)
+	if err != nil {
+		return bt, err
+	}
+	switch {
+	case at == bt:
+		return at, nil
+	case at == jsAnything || bt == jsAnything:
+		return jsAnything, nil
+	case isNumber(at) && isNumber(bt):
+		return jsFloat, nil
+	}
+	return at, fmt.Errorf("both sides of ?: should be the same type, not %s and %s", at, bt)
+}
+
+func (n exprTernary) eval(env valueLookup) (interface{}, error) {
+	c, err := n.cond.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := c.(bool)
+	if !ok {
+		return nil, fmt.Errorf("?: needs a bool, not %v", c)
+	}
+	if b {
+		return n.a.eval(env)
+	}
+	return n.b.eval(env)
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+func (n exprCall) check(types typeLookup) (jsType, error) {
+	argTypes := make([]jsType, len(n.args))
+	for i, arg := range n.args {
+		t, err := arg.check(types)
+		if err != nil {
+			return t, err
+		}
+		argTypes[i] = t
+	}
+	t, err := exprFuncs[n.name].check(argTypes)
+	if err != nil {
+		return t, fmt.Errorf("%s(): %s", n.name, err)
+	}
+	return t, nil
+}
+
+func (n exprCall) eval(env valueLookup) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		val, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = val
+	}
+	return exprFuncs[n.name].call(args)
+}
+
+// helpers
+
+func isNumber(t jsType) bool {
+	return t == jsInt || t == jsFloat
+}
+
+// complains unless t is one of the types (jsAnything goes anywhere, we'll see at runtime)
+func want(t jsType, what string, types ...jsType) error {
+	if t == jsAnything {
+		return nil
+	}
+	for _, ok := range types {
+		if t == ok {
+			return nil
+		}
+	}
+	names := make([]string, len(types))
+	for i, ok := range types {
+		names[i] = string(ok)
+	}
+	return fmt.Errorf("%s needs %s, not %s", what, strings.Join(names, " or "), t)
+}
+
+// 1 == 1.0
+func exprEqual(a, b interface{}) bool {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return x == y
+		}
+	}
+	return equal(a, b)
+}
+
+// functions
+
+type exprFunc struct {
+	check func(args []jsType) (jsType, error)
+	call  func(args []interface{}) (interface{}, error)
+}
+
+var exprFuncs = map[string]exprFunc{
+	"max":      {checkMinMax, func(args []interface{}) (interface{}, error) { return minMax(args, 1) }},
+	"min":      {checkMinMax, func(args []interface{}) (interface{}, error) { return minMax(args, -1) }},
+	"abs":      {checkNumberArg(jsNone), callAbs},
+	"round":    {checkNumberArg(jsInt), callRounder(math.Floor, 0.5)},
+	"floor":    {checkNumberArg(jsInt), callRounder(math.Floor, 0)},
+	"ceil":     {checkNumberArg(jsInt), callRounder(math.Ceil, 0)},
+	"upper":    {checkArgs(jsString, jsString), callString(strings.ToUpper)},
+	"lower":    {checkArgs(jsString, jsString), callString(strings.ToLower)},
+	"trim":     {checkArgs(jsString, jsString), callString(strings.TrimSpace)},
+	"len":      {checkLen, callLen},
+	"str":      {checkStr, callStr},
+	"contains": {checkArgs(jsBool, jsString, jsString), callContains},
+	"replace":  {checkArgs(jsString, jsString, jsString, jsString), callReplace},
+}
+
+// checks for a fixed number of arguments of the given types
+func checkArgs(result jsType, params ...jsType) func([]jsType) (jsType, error) {
+	return func(args []jsType) (jsType, error) {
+		if len(args) != len(params) {
+			return result, fmt.Errorf("takes %d arguments, not %d", len(params), len(args))
+		}
+		for i, t := range args {
+			if err := want(t, fmt.Sprintf("argument %d", i+1), params[i]); err != nil {
+				return result, err
+			}
+		}
+		return result, nil
+	}
+}
+
+// checks for one number, int or float
+// a result of jsNone means the same type as the argument
+func checkNumberArg(result jsType) func([]jsType) (jsType, error) {
+	return func(args []jsType) (jsType, error) {
+		if len(args) != 1 {
+			return result, fmt.Errorf("takes 1 argument, not %d", len(args))
+		}
+		if result == jsNone {
+			return args[0], want(args[0], "argument", jsInt, jsFloat)
+		}
+		return result, want(args[0], "argument", jsInt, jsFloat)
+	}
+}
+
+func checkMinMax(args []jsType) (jsType, error) {
+	if len(args) == 0 {
+		return jsInt, fmt.Errorf("needs at least 1 argument")
+	}
+	result := jsInt
+	for i, t := range args {
+		if err := want(t, fmt.Sprintf("argument %d", i+1), jsInt, jsFloat); err != nil {
+			return result, err
+		}
+		if t != jsInt {
+			result = jsFloat
+		}
+	}
+	return result, nil
+}
+
+func minMax(args []interface{}, sign float64) (interface{}, error) {
+	var best interface{}
+	bestF := 0.0
+	for _, arg := range args {
+		f, ok := toFloat(arg)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a number", arg)
+		}
+		if best == nil || f*sign > bestF*sign {
+			best, bestF = arg, f
+		}
+	}
+	// mixing ints and floats gives a float
+	for _, arg := range args {
+		if _, isInt := arg.(int); !isInt {
+			return bestF, nil
+		}
+	}
+	return best, nil
+}
+
+func callAbs(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case int:
+		if x < 0 {
+			return -x, nil
+		}
+		return x, nil
+	case float64:
+		return math.Abs(x), nil
+	}
+	return nil, fmt.Errorf("%v isn't a number", args[0])
+}
+
+func callRounder(f func(float64) float64, add float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, ok := toFloat(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a number", args[0])
+		}
+		return int(f(x + add)), nil
+	}
+}
+
+func callString(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		str, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a string", args[0])
+		}
+		return f(str), nil
+	}
+}
+
+func checkLen(args []jsType) (jsType, error) {
+	if len(args) != 1 {
+		return jsInt, fmt.Errorf("takes 1 argument, not %d", len(args))
+	}
+	if t := args[0]; t != jsString && t != jsObject && !t.array() && t != jsAnything {
+		return jsInt, fmt.Errorf("needs a string, array or object, not %s", t)
+	}
+	return jsInt, nil
+}
+
+func callLen(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case string:
+		return utf8.RuneCountInString(x), nil
+	case map[string]interface{}:
+		return len(x), nil
+	}
+	if arr := reflect.ValueOf(args[0]); arr.Kind() == reflect.Slice {
+		return arr.Len(), nil
+	}
+	return nil, fmt.Errorf("%v has no length", args[0])
+}
+
+func checkStr(args []jsType) (jsType, error) {
+	if len(args) != 1 {
+		return jsString, fmt.Errorf("takes 1 argument, not %d", len(args))
+	}
+	return jsString, nil
+}
+
+func callStr(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case string:
+		return x, nil
+	case int, float64, bool:
+		return fmt.Sprint(x), nil
+	}
+	b, err := json.Marshal(args[0])
+	return string(b), err
+}
+
+func callContains(args []interface{}) (interface{}, error) {
+	str, ok1 := args[0].(string)
+	sub, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("contains needs strings")
+	}
+	return strings.Contains(str, sub), nil
+}
+
+func callReplace(args []interface{}) (interface{}, error) {
+	str, ok1 := args[0].(string)
+	old, ok2 := args[1].(string)
+	new, ok3 := args[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("replace needs strings")
+	}
+	return strings.Replace(str, old, new, -1), nil
+}
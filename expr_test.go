@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	vars := map[string]struct {
+		type_ jsType
+		value interface{}
+	}{
+		"&a":   {jsInt, 5},
+		"@n":   {jsInt, 7},
+		"@f":   {jsFloat, 2.5},
+		"@s":   {jsString, " Hi "},
+		"@b":   {jsBool, true},
+		"%u":   {jsInt, 3},
+		"#any": {jsAnything, "oops"}, // passes the type check, but isn't a number
+	}
+	types := func(v identifier) (jsType, error) {
+		if x, ok := vars[v.String()]; ok {
+			return x.type_, nil
+		}
+		return jsNone, fmt.Errorf("no such var: %s", v)
+	}
+	values := func(v identifier) interface{} {
+		return vars[v.String()].value
+	}
+
+	cases := []struct {
+		src   string
+		type_ jsType
+		want  interface{}
+		err   string // part of the parse, check or eval error
+	}{
+		// precedence
+		{src: "1 + 2 * 3", type_: jsInt, want: 7},
+		{src: "(1 + 2) * 3", type_: jsInt, want: 9},
+		{src: "2 * 3 % 4", type_: jsInt, want: 2},
+		{src: "10 - 4 - 3", type_: jsInt, want: 3},
+		{src: "-2 * 3", type_: jsInt, want: -6},
+		{src: "!false && false", type_: jsBool, want: false},
+		{src: "1 + 2 > 2 && false || true", type_: jsBool, want: true},
+		{src: "false ? 1 : true ? 2 : 3", type_: jsInt, want: 2},
+
+		// short-circuiting skips the side that would fail
+		{src: "@b || -#any > 0", type_: jsBool, want: true},
+		{src: "!@b && -#any > 0", type_: jsBool, want: false},
+		{src: "@b && -#any > 0", type_: jsBool, err: "- needs a number"},
+		{src: "@b ? 1 : -#any", type_: jsAnything, want: 1},
+
+		// int vs float
+		{src: "@n * 2", type_: jsInt, want: 14},
+		{src: "@n * @f", type_: jsFloat, want: 17.5},
+		{src: "1 + 2.5", type_: jsFloat, want: 3.5},
+		{src: "7 / 2", type_: jsFloat, want: 3.5},
+		{src: "6 / 2", type_: jsFloat, want: 3.0},
+		{src: "7 % 3", type_: jsInt, want: 1},
+		{src: "round(2.5)", type_: jsInt, want: 3},
+		{src: "max(1, 2.5)", type_: jsFloat, want: 2.5},
+		{src: "@n == 7.0", type_: jsBool, want: true},
+
+		// dividing by zero
+		{src: "1 / 0", type_: jsFloat, want: 0.0},
+		{src: "@f / 0", type_: jsFloat, want: 0.0},
+		{src: "5 % 0", type_: jsInt, want: 0},
+
+		// sigils vs operators
+		{src: "&a%2", type_: jsInt, want: 1},
+		{src: "&a % 2", type_: jsInt, want: 1},
+		{src: "@n%&a", type_: jsInt, want: 2},
+		{src: "%u + 1", type_: jsInt, want: 4},
+		{src: "@b&&@b", type_: jsBool, want: true},
+		{src: "&a %u", err: "unexpected"},
+
+		// strings
+		{src: `"a" + 'b'`, type_: jsString, want: "ab"},
+		{src: "upper(trim(@s))", type_: jsString, want: "HI"},
+		{src: "len(@s)", type_: jsInt, want: 4},
+		{src: `"n=" + str(@n)`, type_: jsString, want: "n=7"},
+		{src: `contains(@s, "H")`, type_: jsBool, want: true},
+
+		// mistakes
+		{src: "1 +", err: "at 4"},
+		{src: "(1", err: "at 3"},
+		{src: `"open`, err: "unfinished string"},
+		{src: "nope(1)", err: "no such function: nope"},
+		{src: "@zzz + 1", err: "no such var"},
+		{src: `"a" - 1`, err: "needs"},
+		{src: `"a" + 1`, err: "needs string"},
+		{src: `1 + "a"`, err: "try str()"},
+		{src: "upper(1)", err: "upper(): argument 1 needs string"},
+		{src: `@b ? 1 : "a"`, err: "same type"},
+		{src: "1 % 2.5", err: "needs"},
+		{src: "abs(1, 2)", err: "takes 1 argument"},
+	}
+
+	for _, c := range cases {
+		e, err := parseExpr(c.src)
+		var t_ jsType
+		if err == nil {
+			t_, err = e.check(types)
+		}
+		var got interface{}
+		if err == nil {
+			got, err = e.eval(values)
+		}
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: want error with %q, got %v (%#v)", c.src, c.err, err, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if t_ != c.type_ {
+			t.Errorf("%s: type %s, want %s", c.src, t_, c.type_)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.src, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// process-wide system vars ($clients, $channels, $uptime, $time)
+// the client and channel tables bump the counters, and every tick
+// watchGlobals snapshots them and pokes the channels that care
+
+var (
+	clientCount  int64 // atomic
+	channelCount int64 // atomic
+	startTime    = time.Now()
+
+	globalVars      = make(map[identifier]interface{})
+	globalVarsMutex = &sync.RWMutex{}
+
+	globalSubs      = make(map[*channel]bool)
+	globalSubsMutex = &sync.Mutex{}
+)
+
+func isGlobal(v identifier) bool {
+	switch v {
+	case clientsSysVar, channelsSysVar, uptimeSysVar, timeSysVar:
+		return true
+	}
+	return false
+}
+
+func watchGlobals(tick time.Duration) {
+	updateGlobals(time.Now())
+	for now := range time.Tick(tick) {
+		updateGlobals(now)
+	}
+}
+
+func updateGlobals(now time.Time) {
+	globalVarsMutex.Lock()
+	globalVars[clientsSysVar] = int(atomic.LoadInt64(&clientCount))
+	globalVars[channelsSysVar] = int(atomic.LoadInt64(&channelCount))
+	globalVars[uptimeSysVar] = int(now.Sub(startTime) / time.Second)
+	globalVars[timeSysVar] = int(now.UnixNano() / int64(time.Millisecond))
+	globalVarsMutex.Unlock()
+
+	globalSubsMutex.Lock()
+	defer globalSubsMutex.Unlock()
+	for ch := range globalSubs {
+		// don't wait around, a busy channel will catch up on its next poke
+		select {
+		case ch.poke <- true:
+		default:
+		}
+	}
+}
+
+func globalValue(v identifier) interface{} {
+	globalVarsMutex.RLock()
+	defer globalVarsMutex.RUnlock()
+
+	return globalVars[v]
+}
+
+func subscribeGlobals(ch *channel) {
+	globalSubsMutex.Lock()
+	defer globalSubsMutex.Unlock()
+
+	globalSubs[ch] = true
+}
+
+func unsubscribeGlobals(ch *channel) {
+	globalSubsMutex.Lock()
+	defer globalSubsMutex.Unlock()
+
+	delete(globalSubs, ch)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "fmt"
+
+// [channel.magic.X] group = "%team"
+// runs the spell separately for each value of another user var,
+// giving an object like {"red": 12, "blue": 9}
+
+// makes magic that casts sig once per group
+func makeGroupMagic(src, by magicSource, sig spell, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		result := make(map[string]interface{})
+		for key, sub := range groupSources(src, by) {
+			result[key] = makeMagic(sub, sig, params)()
+		}
+		return result
+	}
+}
+
+// splits src up by the value each user has for by
+func groupSources(src, by magicSource) map[string]*groupSource {
+	// users filtered out by where shouldn't count towards their group
+	var pass map[*client]bool
+	if f, ok := src.(filteredSource); ok {
+		pass = f.passing()
+	}
+
+	byVals := by.values()
+	groups := make(map[string]*groupSource)
+	for c, val := range byVals {
+		if pass != nil && !pass[c] {
+			continue
+		}
+		key := groupKey(val)
+		if groups[key] == nil {
+			groups[key] = &groupSource{vals: make(map[*client]interface{}), type_: src.srcType()}
+		}
+		groups[key].members++
+	}
+	for c, val := range src.values() {
+		if g := groups[groupKey(byVals[c])]; g != nil {
+			g.vals[c] = val
+		}
+	}
+	return groups
+}
+
+func groupKey(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return str
+	}
+	return fmt.Sprint(v)
+}
+
+// the users in one group
+type groupSource struct {
+	vals    map[*client]interface{}
+	type_   jsType
+	members int
+}
+
+func (s *groupSource) values() map[*client]interface{} {
+	return s.vals
+}
+
+func (s *groupSource) srcType() jsType {
+	return s.type_
+}
+
+func (s *groupSource) listeners() int {
+	return s.members
+}
@@ -2,17 +2,22 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"time"
 	"unicode/utf8"
 
 	"code.google.com/p/go.net/websocket"
 )
 
 var configFile = flag.String("config", "config.toml", "config file path")
+var checkOnly = flag.Bool("check", false, "check the config file and quit")
 var currentConfig config
+var currentAuth authenticator
 var templates = make(map[rune]channelTemplate)
 
 func main() {
@@ -20,21 +25,34 @@ func main() {
 
 	// load config
 	cfg, ok := parseConfig(*configFile)
+	if *checkOnly {
+		if !ok {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", *configFile)
+		return
+	}
 	if !ok {
 		log.Println("Bad config file, giving up.")
 		return
 	}
 	currentConfig = cfg
+	currentAuth = newKeyTable(cfg.Logins)
 	channelBanner := ""
 	for _, tmpl := range cfg.Channels {
 		channelBanner += tmpl.Prefix
 		prefix, _ := utf8.DecodeRuneInString(tmpl.Prefix)
 		templates[prefix] = tmpl
 	}
+	prepareRooms(cfg.Channels)
+	prepareAggregates(cfg.Channels)
 
 	// start http services
 	log.Printf("Hakobiya: Starting %s @ %s%s", cfg.Server.Name, cfg.Server.Bind, cfg.Server.Path)
 	log.Printf("Channels (%d): %s", len(templates), channelBanner)
+	log.Printf("Logins: %d", len(cfg.Logins))
+	tick, _ := time.ParseDuration(cfg.Server.Tick)
+	go watchGlobals(tick)
 	http.Handle(cfg.Server.Path, websocket.Handler(serveWS))
 	// api
 	if cfg.API.Enabled {
@@ -7,6 +7,9 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 		jpCount: {},
 		chanQueue: {},
 		URL: null,
+		userID: null,
+		roles: [],
+		peers: {},
 
 		connect: function(addr) {
 			var self = this;
@@ -34,6 +37,26 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 						var id = data.c + "." + data.n;
 						$rootScope.$broadcast(id, data.v);
 						break;
+					case 'U': //everyone's public var
+						var id = data.c + "." + data.n;
+						self.peers[id] = data.v || {};
+						$rootScope.$broadcast("*" + id, self.peers[id]);
+						break;
+					case 'u': //someone's public var
+						var id = data.c + "." + data.n;
+						var peers = self.peers[id] || (self.peers[id] = {});
+						if (data.p) {
+							delete peers[data.u];
+						} else {
+							peers[data.u] = data.v;
+						}
+						$rootScope.$broadcast("*" + id, peers);
+						break;
+					case 'l': //logged in
+						self.userID = data.u;
+						self.roles = data.r || [];
+						$rootScope.$broadcast("login", data.u);
+						break;
 					case 'j': //joined
 						self.jpCount[data.c] = 1;
 						// send any waiting msgs
@@ -53,6 +76,11 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 							v = "[" + data.c + "]"
 						}
 						console.log("error (" + data.w + "): " + v + " " + data.m);
+						if (data.w == 'j') {
+							// join rejected
+							var rejectEvt = data.c + " reject";
+							$rootScope.$broadcast(rejectEvt, data.m);
+						}
 						break;
 				}
 			};
@@ -76,6 +104,12 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 				}
 			}	
 		},
+		login: function(key) {
+			this.send({
+				x: 'l',
+				k: key
+			});
+		},
 		joined: function(channel) {
 			return this.jpCount[channel] > 0;
 		},
@@ -152,7 +186,7 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 			});
 
 			// let the binding begin
-			var requestableSigils = "&$%";
+			var requestableSigils = "&$%#@";
 			var settableSigils = "%";
 			var request = [];
 			angular.forEach(binding, function(hvar, scopevar) {
@@ -161,7 +195,7 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 				if (requestable) {
 					var value = $scope[scopevar];
 					var settable = settableSigils.indexOf(sigil) != -1;
-					if (!value) {
+					if (!value || !settable) {
 						request.push(hvar);
 					} else if (settable) {
 						self.set(chan, hvar, value);
@@ -169,9 +203,19 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 				}
 
 				var id = chan + "." + hvar;
+				if (sigil == '*') {
+					// everyone's public var, like "*%name"
+					// one-way binding to an object of user ID -> value
+					id = "*" + chan + "." + hvar.substr(1);
+					if (self.peers[id.substr(1)]) {
+						$scope[scopevar] = self.peers[id.substr(1)];
+					}
+				}
 				switch (sigil) {
+					case '*': // public user vars, same
 					case '&': // magic var, one-way server -> client binding
 					case '$': // system var, same
+					case '@': // channel var, same (the API sets these)
 						$scope.$on(id, function(e, value) {
 							$scope.$apply(function(scope) {
 								scope[scopevar] = value;
@@ -188,16 +232,21 @@ hakobiyaModule.factory('Hakobiya', function($rootScope) {
 							self.set(chan, hvar, newVal);
 						});
 						break;
-					case '#': // broadcasts, one way growing array
+					case '#': // broadcasts, two-way binding shared by the whole channel
+						var fromServer; // last value the channel sent us
 						$scope.$on(id, function(e, value) {
+							fromServer = angular.copy(value);
 							$scope.$apply(function(scope) {
-								if (scope[scopevar]) {
-									scope[scopevar].push(value);
-								} else {
-									scope[scopevar] = [value];
-								}
+								scope[scopevar] = value;
 							});
 						});
+						$scope.$watch(scopevar, function(newVal, oldVal) {
+							// don't clobber the channel's value with our initial one,
+							// and don't echo back what the channel just told us
+							if (newVal !== oldVal && !angular.equals(newVal, fromServer)) {
+								self.set(chan, hvar, newVal);
+							}
+						});
 						break;
 					case '=': // wire, like a two-way broadcast. special array
 						var wire = [];
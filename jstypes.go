@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+)
+
 type jsType string
 
 const (
@@ -61,17 +67,103 @@ func (me jsType) is(v interface{}) bool {
 	case jsStringArray:
 		_, ok := v.([]string)
 		return ok
+	case jsObject:
+		_, ok := v.(map[string]interface{})
+		return ok
+	case jsObjectArray:
+		_, ok := v.([]map[string]interface{})
+		return ok
 	case jsAnythingArray:
 		_, ok := v.([]interface{})
 		return ok
 	case jsAnything:
 		return true
-	default:
-		panic(".is(): unknown jsType! " + me)
 	}
 	return false
 }
 
+// converts decoded values (from JSON, TOML and such) into the Go types we use for me
+// ok is false if it doesn't fit
+func (me jsType) normalize(v interface{}) (val interface{}, ok bool) {
+	v = plainNumbers(v)
+	switch me {
+	case jsInt:
+		// plainNumbers already turned anything whole into an int
+		n, ok := v.(int)
+		return n, ok
+	case jsFloat:
+		switch n := v.(type) {
+		case float64:
+			return n, true
+		case int:
+			return float64(n), true
+		}
+		return nil, false
+	}
+	if me.array() {
+		return me.normalizeArray(v)
+	}
+	return v, me.is(v)
+}
+
+// checks every element of a decoded array and copies it into the right kind of slice
+func (me jsType) normalizeArray(v interface{}) (val interface{}, ok bool) {
+	if me.is(v) {
+		return v, true
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	elemType := me.elem()
+	out := reflect.MakeSlice(reflect.TypeOf(me.zero()), len(arr), len(arr))
+	for i, e := range arr {
+		e, ok := elemType.normalize(e)
+		if !ok {
+			return nil, false
+		}
+		if e != nil { // null is fine for any[]
+			out.Index(i).Set(reflect.ValueOf(e))
+		}
+	}
+	return out.Interface(), true
+}
+
+// turns json.Numbers and other odd numeric types into ints (if they're whole) or float64s, all the way down
+func plainNumbers(v interface{}) interface{} {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return int(i)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return n.String()
+		}
+		return plainNumbers(f)
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			return int(n)
+		}
+		return n
+	case float32:
+		return plainNumbers(float64(n))
+	case int64:
+		return int(n)
+	case []interface{}:
+		for i, elem := range n {
+			n[i] = plainNumbers(elem)
+		}
+		return n
+	case map[string]interface{}:
+		for k, elem := range n {
+			n[k] = plainNumbers(elem)
+		}
+		return n
+	}
+	return v
+}
+
 func (me jsType) zero() interface{} {
 	switch me {
 	case jsBool:
@@ -90,24 +182,56 @@ func (me jsType) zero() interface{} {
 		return ""
 	case jsStringArray:
 		return []string{}
+	case jsObject:
+		return map[string]interface{}{}
+	case jsObjectArray:
+		return []map[string]interface{}{}
 	case jsAnything:
 		return ""
 	case jsAnythingArray:
 		return []interface{}{}
-	default:
-		panic(".zero(): unknown jsType! " + me)
 	}
+	// config.check should have caught this
+	return nil
 }
 
 func (me jsType) any() jsType {
+	if me.array() {
+		return jsAnythingArray
+	}
+	return jsAnything
+}
+
+func (me jsType) array() bool {
 	switch me {
-	case jsBool, jsInt, jsFloat, jsString, jsAnything:
+	case jsBoolArray, jsIntArray, jsFloatArray, jsStringArray, jsObjectArray, jsAnythingArray:
+		return true
+	}
+	return false
+}
+
+// element type of an array type, or jsNone if me isn't an array
+func (me jsType) elem() jsType {
+	switch me {
+	case jsBoolArray:
+		return jsBool
+	case jsIntArray:
+		return jsInt
+	case jsFloatArray:
+		return jsFloat
+	case jsStringArray:
+		return jsString
+	case jsObjectArray:
+		return jsObject
+	case jsAnythingArray:
 		return jsAnything
-	case jsBoolArray, jsIntArray, jsFloatArray, jsStringArray, jsAnythingArray:
-		return jsAnythingArray
-	default:
-		panic(".any(): unknown jsType! " + me)
 	}
+	return jsNone
+}
+
+// like ==, but works on arrays and objects too
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
 }
 
 func (me jsType) MarshalText() (text []byte, err error) {
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"unicode/utf8"
+)
+
+// $rooms lets lobby channels list the live channels of some prefix
+// listed channels keep their entry up to date and poke the lobbies watching them
+
+// an entry in $rooms
+type roomInfo struct {
+	Name      string                 `json:"name"`
+	Listeners int                    `json:"listeners"`
+	Vars      map[string]interface{} `json:"vars,omitempty"`
+}
+
+// same fields as the JSON
+func (info roomInfo) object() map[string]interface{} {
+	obj := map[string]interface{}{
+		"name":      info.Name,
+		"listeners": info.Listeners,
+	}
+	if len(info.Vars) > 0 {
+		obj["vars"] = info.Vars
+	}
+	return obj
+}
+
+// [channel.rooms]
+type roomsDef struct {
+	Prefix string
+	Vars   []identifier // channel or broadcast vars to show for each room
+}
+
+func (def roomsDef) prefix() rune {
+	r, _ := utf8.DecodeRuneInString(def.Prefix)
+	return r
+}
+
+var (
+	roomTable  = make(map[rune]map[string]roomInfo) // prefix → channel name → info
+	roomVars   = make(map[rune][]identifier)        // vars to share, by prefix
+	lobbies    = make(map[rune]map[*channel]bool)   // who's watching, by prefix
+	roomsMutex = &sync.RWMutex{}
+)
+
+// sets up listings for every prefix some lobby wants to see
+func prepareRooms(tmpls []channelTemplate) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	for _, tmpl := range tmpls {
+		if tmpl.Rooms == nil {
+			continue
+		}
+		p := tmpl.Rooms.prefix()
+		if roomTable[p] == nil {
+			roomTable[p] = make(map[string]roomInfo)
+			lobbies[p] = make(map[*channel]bool)
+		}
+		for _, v := range tmpl.Rooms.Vars {
+			if !hasIdentifier(roomVars[p], v) {
+				roomVars[p] = append(roomVars[p], v)
+			}
+		}
+	}
+}
+
+// is anyone watching channels with this prefix?
+func roomsWatched(prefix rune) bool {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	_, watched := roomTable[prefix]
+	return watched
+}
+
+// what a listed channel should share about itself
+func sharedRoomVars(prefix rune) []identifier {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	return roomVars[prefix]
+}
+
+func listRoom(info roomInfo, prefix rune) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	roomTable[prefix][info.Name] = info
+	pokeLobbies(prefix)
+}
+
+func unlistRoom(name string, prefix rune) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	delete(roomTable[prefix], name)
+	pokeLobbies(prefix)
+}
+
+// call with roomsMutex held
+func pokeLobbies(prefix rune) {
+	for lobby := range lobbies[prefix] {
+		select {
+		case lobby.poke <- true:
+		default:
+		}
+	}
+}
+
+// sorted copy of the listings for a prefix
+func roomList(prefix rune) []roomInfo {
+	roomsMutex.RLock()
+	defer roomsMutex.RUnlock()
+
+	list := make([]roomInfo, 0, len(roomTable[prefix]))
+	for _, info := range roomTable[prefix] {
+		list = append(list, info)
+	}
+	sort.Sort(byRoomName(list))
+	return list
+}
+
+func watchRooms(lobby *channel, prefix rune) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	lobbies[prefix][lobby] = true
+}
+
+func unwatchRooms(lobby *channel, prefix rune) {
+	roomsMutex.Lock()
+	defer roomsMutex.Unlock()
+
+	delete(lobbies[prefix], lobby)
+}
+
+type byRoomName []roomInfo
+
+func (r byRoomName) Len() int           { return len(r) }
+func (r byRoomName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRoomName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+func hasIdentifier(list []identifier, v identifier) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
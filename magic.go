@@ -19,15 +19,75 @@ func (s spell) String() string {
 
 type magicEntry struct {
 	f          magicMaker
+	fv         viewerMaker // set instead of f for per-viewer magic
+	ft         tallyMaker  // optional, see tally.go
 	returnType jsType
 }
 
 // magic function generator
-// func(*channel, src var name, params)
-type magicMaker func(*channel, identifier, map[string]interface{}) func() interface{}
+// func(where to get values, params)
+type magicMaker func(magicSource, map[string]interface{}) func() interface{}
+
+// per-viewer magic function generator
+// like magicMaker, but the result depends on who's looking
+// the outer func runs once per recompute, to do the work everyone shares,
+// then the func it gives back runs once for each viewer
+type viewerMaker func(magicSource, map[string]interface{}) func() func(viewer *client) interface{}
+
+// where magic gets its values from
+type magicSource interface {
+	values() map[*client]interface{}
+	srcType() jsType
+	listeners() int
+}
+
+// a user var in one channel, the usual source
+type userVarSource struct {
+	ch *channel
+	v  identifier
+}
+
+func (s userVarSource) values() map[*client]interface{} {
+	values, _ := s.ch.values(s.v)
+	return values
+}
+
+func (s userVarSource) srcType() jsType {
+	return s.ch.types[s.v]
+}
+
+func (s userVarSource) listeners() int {
+	return len(s.ch.listeners)
+}
+
+// any other var (other magic, $listeners, etc.), as if one user had it
+type scalarSource struct {
+	ch    *channel
+	v     identifier
+	type_ jsType
+}
+
+// the "user" holding a scalarSource's value
+var nobody = &client{}
+
+func (s scalarSource) values() map[*client]interface{} {
+	return map[*client]interface{}{nobody: s.ch.peek(s.v)}
+}
+
+func (s scalarSource) srcType() jsType {
+	return s.type_
+}
+
+func (s scalarSource) listeners() int {
+	return 1
+}
 
 func registerMagic(sig spell, f magicMaker, returnType jsType) {
-	grimoire[sig] = magicEntry{f, returnType}
+	grimoire[sig] = magicEntry{f: f, returnType: returnType}
+}
+
+func registerViewerMagic(sig spell, f viewerMaker, returnType jsType) {
+	grimoire[sig] = magicEntry{fv: f, returnType: returnType}
 }
 
 func hasMagic(sig spell) bool {
@@ -41,6 +101,27 @@ func hasMagic(sig spell) bool {
 	return false
 }
 
+// does every viewer get their own value?
+func isViewerMagic(sig spell) bool {
+	m, ok := grimoire[sig]
+	if !ok {
+		m, ok = grimoire[sig.generic()]
+	}
+	return ok && m.fv != nil
+}
+
+// what sig gives back, or jsNone if there's no such spell
+func returnType(sig spell) jsType {
+	m, ok := grimoire[sig]
+	if !ok {
+		m, ok = grimoire[sig.generic()]
+	}
+	if !ok {
+		return jsNone
+	}
+	return m.returnType
+}
+
 func defaultValue(sig spell) interface{} {
 	if m, ok := grimoire[sig]; ok {
 		return m.returnType.zero()
@@ -48,7 +129,7 @@ func defaultValue(sig spell) interface{} {
 	return nil
 }
 
-func makeMagic(ch *channel, src identifier, sig spell, params map[string]interface{}) func() interface{} {
+func makeMagic(src magicSource, sig spell, params map[string]interface{}) func() interface{} {
 	m, ok := grimoire[sig]
 	if !ok {
 		// is there a generic function?
@@ -57,5 +138,16 @@ func makeMagic(ch *channel, src identifier, sig spell, params map[string]interfa
 			panic("unknown magic signature for: " + sig.String())
 		}
 	}
-	return m.f(ch, src, params)
+	return m.f(src, params)
+}
+
+func makeViewerMagic(src magicSource, sig spell, params map[string]interface{}) func() func(*client) interface{} {
+	m, ok := grimoire[sig]
+	if !ok {
+		m, ok = grimoire[sig.generic()]
+		if !ok {
+			panic("unknown magic signature for: " + sig.String())
+		}
+	}
+	return m.fv(src, params)
 }
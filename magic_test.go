@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// every spell config.check lets you cast on a system var should work on its actual value
+func TestSpellsOnSystemVars(t *testing.T) {
+	var expose []identifier
+	for v := range sysVarTypes {
+		expose = append(expose, v)
+	}
+	templates['y'] = channelTemplate{
+		Prefix: "y",
+		Expose: expose,
+		Rooms:  &roomsDef{Prefix: "z"},
+	}
+	updateGlobals(time.Now())
+	ch := newChannel("y-spells")
+
+	castAll := func(state string) {
+		for v, type_ := range sysVarTypes {
+			src := scalarSource{ch, v, type_}
+			for sig, m := range grimoire {
+				// the generic version is only used when there isn't one for the exact type, see makeMagic
+				if _, exact := grimoire[spell{type_, sig.name}]; sig.type_ != type_ && (sig.type_ != type_.any() || exact) {
+					continue
+				}
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s: %s on %s panicked: %v", state, sig, v, r)
+						}
+					}()
+					var val interface{}
+					if m.fv != nil {
+						val = m.fv(src, nil)()(nobody)
+					} else {
+						val = m.f(src, nil)()
+					}
+					if _, ok := m.returnType.normalize(val); !ok {
+						t.Errorf("%s: %s on %s gave %#v, not %s", state, sig, v, val, m.returnType)
+					}
+				}()
+			}
+		}
+	}
+	// counts non-empty lists, so it has to get the zero value right
+	count := func(v identifier) interface{} {
+		return makeViewerMagic(scalarSource{ch, v, sysVarTypes[v]}, spell{sysVarTypes[v], "count_others"}, nil)()(nil)
+	}
+
+	castAll("empty")
+	for _, v := range []identifier{usersSysVar, roomsSysVar} {
+		if n := count(v); n != 0 {
+			t.Errorf("empty: count_others on %s = %v, want 0", v, n)
+		}
+	}
+
+	// someone joins and a room opens up
+	c := &client{id: "yu", sendq: make(chan interface{}, 100)}
+	ch.listeners[c] = true
+	ch.joined[c] = time.Now()
+	ch.updateUsers()
+	roomsMutex.Lock()
+	roomTable['z'] = map[string]roomInfo{"z1": {Name: "z1", Listeners: 1}}
+	roomsMutex.Unlock()
+	ch.refreshRooms()
+	ch.refreshGlobals()
+
+	castAll("full")
+	for _, v := range []identifier{usersSysVar, roomsSysVar} {
+		if n := count(v); n != 1 {
+			t.Errorf("full: count_others on %s = %v, want 1", v, n)
+		}
+	}
+	roomsMutex.Lock()
+	delete(roomTable, 'z')
+	roomsMutex.Unlock()
+	delete(templates, 'y')
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+)
+
+// holds back magic with throttle or debounce set
+// the recompute (and notify) happens later, from channel.run's alarm
+type pacer struct {
+	throttle time.Duration
+	debounce time.Duration
+	last     time.Time // last recompute
+	due      time.Time // when the held back recompute happens, zero if there isn't one
+}
+
+// called when the magic goes stale, true if it should be recomputed right now
+func (p *pacer) stale(now time.Time) bool {
+	if p.debounce > 0 {
+		// wait for things to calm down
+		p.due = now.Add(p.debounce)
+		return false
+	}
+	if p.due.IsZero() {
+		if now.Sub(p.last) >= p.throttle {
+			p.last = now
+			return true
+		}
+		p.due = p.last.Add(p.throttle)
+	}
+	return false
+}
+
+// recomputes the held back magic whose time has come, and everything built on it
+func (ch *channel) flushPaced() {
+	now := time.Now()
+	ready := make(map[identifier]bool)
+	stale := make(map[identifier]bool)
+	for v, p := range ch.paced {
+		if !p.due.IsZero() && !p.due.After(now) {
+			p.due = time.Time{}
+			p.last = now
+			ready[v] = true
+			for dep := range ch.downstream(v) {
+				stale[dep] = true
+			}
+		}
+	}
+	for _, v := range ch.order {
+		switch {
+		case ready[v]:
+			ch.recompute(v)
+		case stale[v]:
+			if p, ok := ch.paced[v]; !ok || p.stale(now) {
+				ch.recompute(v)
+			}
+		}
+	}
+}
+
+// sets the alarm for the next held back magic, or turns it off if there isn't any
+func (ch *channel) setAlarm() {
+	var next time.Time
+	for _, p := range ch.paced {
+		if !p.due.IsZero() && (next.IsZero() || p.due.Before(next)) {
+			next = p.due
+		}
+	}
+	if next.Equal(ch.alarmAt) {
+		return
+	}
+	if ch.alarm != nil {
+		ch.alarm.Stop()
+		ch.alarm = nil
+		ch.wake = nil
+	}
+	ch.alarmAt = next
+	if !next.IsZero() {
+		ch.alarm = time.NewTimer(next.Sub(time.Now()))
+		ch.wake = ch.alarm.C
+	}
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
 type request struct {
 	Cmd string `json:"x"`
 }
@@ -14,6 +20,12 @@ type loginRequest struct {
 	Key string `json:"k"`
 }
 
+type loginReply struct {
+	Cmd   string   `json:"x"` // l
+	ID    clientID `json:"u"`
+	Roles []string `json:"r,omitempty"`
+}
+
 type getRequest struct {
 	Cmd     string     `json:"x"` // g
 	Channel string     `json:"c"`
@@ -33,6 +45,17 @@ type setRequest struct {
 	Value   interface{} `json:"v"`
 }
 
+// public user var updates, server -> client only
+// U has every user's value in Value, u has one user's (or Gone if they left)
+type peerMessage struct {
+	Cmd     string      `json:"x"` // u or U
+	Channel string      `json:"c"`
+	Var     identifier  `json:"n"`
+	User    clientID    `json:"u,omitempty"`
+	Value   interface{} `json:"v"`
+	Gone    bool        `json:"p,omitempty"`
+}
+
 type multisetRequest struct {
 	Cmd     string                     `json:"x"` // S
 	Channel string                     `json:"c"`
@@ -50,3 +73,15 @@ type errorMessage struct {
 func (e errorMessage) Error() string {
 	return e.Message
 }
+
+// like json.Unmarshal, but numbers come out as json.Number so ints stay ints
+// see plainNumbers for turning them back into Go numbers
+func decode(data []byte, v interface{}) error {
+	return decodeFrom(bytes.NewReader(data), v)
+}
+
+func decodeFrom(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
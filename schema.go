@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// describes the shape of object (and array) values, like a tiny JSON Schema
+// [channel.var.X.schema], [channel.wire.X.schema], etc.
+// the top level inherits the type of the thing it's attached to
+type schema struct {
+	Type        jsType
+	Properties  map[string]*schema
+	Items       *schema // for arrays, the schema of each element
+	Strict      bool    // reject keys not in properties
+	constraints         // required lives in here
+
+	errs []string // config problems found by compile, reported by config.check
+}
+
+// gets the schema ready to validate values of type t
+func (s *schema) compile(t jsType) {
+	if s.Type == jsAnything {
+		s.Type = t
+	}
+	s.errs = s.compileAt("schema")
+	// otherwise every value would be turned away
+	if s.Type != t && t != jsAnything && !(t == jsAnythingArray && s.Type.array()) {
+		s.errs = append(s.errs, fmt.Sprintf("schema: type %s doesn't match the var's type %s", s.Type, t))
+	}
+}
+
+func (s *schema) compileAt(path string) (errs []string) {
+	if !s.Type.valid() {
+		return []string{fmt.Sprintf("%s: Invalid type: %s", path, s.Type)}
+	}
+	s.constraints.compile(s.Type)
+	for _, e := range s.constraints.errs {
+		errs = append(errs, fmt.Sprintf("%s: %s", path, e))
+	}
+
+	isObject := s.Type == jsObject || s.Type == jsAnything
+	if (len(s.Properties) > 0 || s.Strict) && !isObject {
+		errs = append(errs, fmt.Sprintf("%s: properties only work on objects, not %s", path, s.Type))
+	}
+	for name, prop := range s.Properties {
+		errs = append(errs, prop.compileAt(path+".properties."+name)...)
+	}
+
+	if s.Items != nil {
+		switch {
+		case !s.Type.array():
+			errs = append(errs, fmt.Sprintf("%s: items only works on arrays, not %s", path, s.Type))
+		case s.Items.Type == jsAnything:
+			s.Items.Type = s.Type.elem()
+		case s.Type != jsAnythingArray && s.Items.Type != s.Type.elem():
+			errs = append(errs, fmt.Sprintf("%s: items type %s doesn't fit in %s", path, s.Items.Type, s.Type))
+		}
+		errs = append(errs, s.Items.compileAt(path+".items")...)
+	}
+	return
+}
+
+// checks v against the schema, fixing up the types of nested values as it goes
+// returns the fixed value, or what's wrong with it
+func (s *schema) conform(v interface{}) (interface{}, string) {
+	if s == nil {
+		return v, ""
+	}
+	return s.conformAt(v, "value")
+}
+
+func (s *schema) conformAt(v interface{}, path string) (interface{}, string) {
+	val, ok := s.Type.normalize(v)
+	if !ok {
+		return nil, fmt.Sprintf("%s should be of type %s", path, s.Type)
+	}
+	if msg := s.constraints.check(val); msg != "" {
+		return nil, fmt.Sprintf("%s: %s", path, msg)
+	}
+
+	if obj, ok := val.(map[string]interface{}); ok {
+		for k, x := range obj {
+			prop, known := s.Properties[k]
+			if !known {
+				if s.Strict {
+					return nil, fmt.Sprintf("%s: unknown key: %s", path, k)
+				}
+				continue
+			}
+			fixed, msg := prop.conformAt(x, path+"."+k)
+			if msg != "" {
+				return nil, msg
+			}
+			obj[k] = fixed
+		}
+	}
+
+	if s.Items != nil {
+		arr := reflect.ValueOf(val)
+		for i := 0; i < arr.Len(); i++ {
+			fixed, msg := s.Items.conformAt(arr.Index(i).Interface(), fmt.Sprintf("%s[%d]", path, i))
+			if msg != "" {
+				return nil, msg
+			}
+			if fixed != nil {
+				arr.Index(i).Set(reflect.ValueOf(fixed))
+			}
+		}
+	}
+
+	return val, ""
+}
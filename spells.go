@@ -1,11 +1,18 @@
 package main
 
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
 // these are the functions you can use in [channel.magic.*] stuff
 
 // returns the sum
-func _int_sum(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _int_sum(src magicSource, params map[string]interface{}) func() interface{} {
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		sum := 0
 		for _, val := range values {
 			sum += val.(int)
@@ -15,18 +22,24 @@ func _int_sum(ch *channel, src identifier, params map[string]interface{}) func()
 }
 
 // returns the average (rounded to an int)
-func _int_avg(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
-	sumFunc := _int_sum(ch, src, params)
+func _int_avg(src magicSource, params map[string]interface{}) func() interface{} {
 	return func() interface{} {
-		sum, ct := sumFunc().(int), len(ch.listeners)
-		return sum / ct
+		values := src.values()
+		if len(values) == 0 {
+			return 0
+		}
+		sum := 0
+		for _, val := range values {
+			sum += val.(int)
+		}
+		return sum / len(values)
 	}
 }
 
 // returns the maximum value
-func _int_max(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _int_max(src magicSource, params map[string]interface{}) func() interface{} {
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		var max *int
 		for _, val := range values {
 			n := val.(int)
@@ -38,14 +51,17 @@ func _int_max(ch *channel, src identifier, params map[string]interface{}) func()
 				}
 			}
 		}
+		if max == nil {
+			return 0
+		}
 		return *max
 	}
 }
 
 // returns the minimum value
-func _int_min(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _int_min(src magicSource, params map[string]interface{}) func() interface{} {
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		var min *int
 		for _, val := range values {
 			n := val.(int)
@@ -57,21 +73,455 @@ func _int_min(ch *channel, src identifier, params map[string]interface{}) func()
 				}
 			}
 		}
+		if min == nil {
+			return 0
+		}
 		return *min
 	}
 }
 
+// returns the sum
+func _float_sum(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		sum := 0.0
+		for _, n := range floatValues(src) {
+			sum += n
+		}
+		return sum
+	}
+}
+
+// returns the average
+func _float_avg(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		return mean(floatValues(src))
+	}
+}
+
+// returns the maximum value
+func _float_max(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		values := floatValues(src)
+		if len(values) == 0 {
+			return 0.0
+		}
+		max := values[0]
+		for _, n := range values[1:] {
+			max = math.Max(max, n)
+		}
+		return max
+	}
+}
+
+// returns the minimum value
+func _float_min(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		values := floatValues(src)
+		if len(values) == 0 {
+			return 0.0
+		}
+		min := values[0]
+		for _, n := range values[1:] {
+			min = math.Min(min, n)
+		}
+		return min
+	}
+}
+
+// returns the middle value (or the average of the two middle values)
+func _float_median(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		return percentile(floatValues(src), 50)
+	}
+}
+
+// returns the (population) standard deviation
+func _float_stddev(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		values := floatValues(src)
+		if len(values) == 0 {
+			return 0.0
+		}
+		avg := mean(values)
+		sum := 0.0
+		for _, n := range values {
+			sum += (n - avg) * (n - avg)
+		}
+		return math.Sqrt(sum / float64(len(values)))
+	}
+}
+
+// returns the 'value' parameter-th percentile (0 to 100), interpolating between values
+// if no 'value' param is given, returns the median
+func _float_percentile(src magicSource, params map[string]interface{}) func() interface{} {
+	p := 50.0
+	if param, ok := toFloat(params["value"]); ok {
+		p = math.Max(0, math.Min(100, param))
+	}
+	return func() interface{} {
+		return percentile(floatValues(src), p)
+	}
+}
+
+// source values as float64s, sorted
+func floatValues(src magicSource) []float64 {
+	values := src.values()
+	nums := make([]float64, 0, len(values))
+	for _, val := range values {
+		if n, ok := toFloat(val); ok {
+			nums = append(nums, n)
+		}
+	}
+	sort.Float64s(nums)
+	return nums
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, n := range values {
+		sum += n
+	}
+	return sum / float64(len(values))
+}
+
+// p-th percentile of sorted values, 0 if there aren't any
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// joins the non-empty values with the 'separator' parameter (or 'value', default ", ")
+func _string_join(src magicSource, params map[string]interface{}) func() interface{} {
+	sep := ", "
+	if str, ok := params["separator"].(string); ok {
+		sep = str
+	} else if str, ok := params["value"].(string); ok {
+		sep = str
+	}
+	return func() interface{} {
+		var strs []string
+		for _, str := range stringValues(src) {
+			if str != "" {
+				strs = append(strs, str)
+			}
+		}
+		return strings.Join(strs, sep)
+	}
+}
+
+// returns every value, sorted
+func _string_list(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		return stringValues(src)
+	}
+}
+
+// returns every different value, sorted
+func _string_unique(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		unique := []string{}
+		for _, str := range stringValues(src) {
+			if len(unique) == 0 || unique[len(unique)-1] != str {
+				unique = append(unique, str)
+			}
+		}
+		return unique
+	}
+}
+
+// returns the most common value
+// ties go to the value that sorts first
+func _string_mode(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		mode, best := "", 0
+		counts := make(map[string]int)
+		for _, str := range stringValues(src) {
+			counts[str]++
+			// values are sorted, so only a strictly bigger count wins
+			if counts[str] > best {
+				mode, best = str, counts[str]
+			}
+		}
+		return mode
+	}
+}
+
+// returns an object of value → how many users have it
+func _string_histogram(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		hist := make(map[string]interface{})
+		for _, str := range stringValues(src) {
+			n, _ := hist[str].(int)
+			hist[str] = n + 1
+		}
+		return hist
+	}
+}
+
+// source values as strings, sorted
+func stringValues(src magicSource) []string {
+	values := src.values()
+	strs := make([]string, 0, len(values))
+	for _, val := range values {
+		if str, ok := val.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// returns every item that's in any of the arrays, once each
+func _array_union(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		union := emptyArray(src)
+		for _, arr := range arrayValues(src) {
+			for i := 0; i < arr.Len(); i++ {
+				if item := arr.Index(i); !arrayHas(union, item.Interface()) {
+					union = reflect.Append(union, item)
+				}
+			}
+		}
+		return union.Interface()
+	}
+}
+
+// returns the items that are in every array
+func _array_intersection(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		isect := emptyArray(src)
+		arrays := arrayValues(src)
+		if len(arrays) == 0 {
+			return isect.Interface()
+		}
+	items:
+		for i := 0; i < arrays[0].Len(); i++ {
+			item := arrays[0].Index(i)
+			if arrayHas(isect, item.Interface()) {
+				continue
+			}
+			for _, arr := range arrays[1:] {
+				if !arrayHas(arr, item.Interface()) {
+					continue items
+				}
+			}
+			isect = reflect.Append(isect, item)
+		}
+		return isect.Interface()
+	}
+}
+
+// returns all the arrays stuck together
+func _array_concat(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		all := emptyArray(src)
+		for _, arr := range arrayValues(src) {
+			all = reflect.AppendSlice(all, arr)
+		}
+		return all.Interface()
+	}
+}
+
+// source values in a stable order (by user ID)
+func arrayValues(src magicSource) []reflect.Value {
+	values := src.values()
+	clients := make([]*client, 0, len(values))
+	for c := range values {
+		clients = append(clients, c)
+	}
+	sort.Sort(byClientID(clients))
+
+	arrays := make([]reflect.Value, 0, len(values))
+	for _, c := range clients {
+		if arr := reflect.ValueOf(values[c]); arr.Kind() == reflect.Slice {
+			arrays = append(arrays, arr)
+		}
+	}
+	return arrays
+}
+
+func emptyArray(src magicSource) reflect.Value {
+	return reflect.ValueOf(src.srcType().zero())
+}
+
+func arrayHas(arr reflect.Value, x interface{}) bool {
+	for i := 0; i < arr.Len(); i++ {
+		if equal(arr.Index(i).Interface(), x) {
+			return true
+		}
+	}
+	return false
+}
+
+type byClientID []*client
+
+func (cs byClientID) Len() int           { return len(cs) }
+func (cs byClientID) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byClientID) Less(i, j int) bool { return cs[i].id < cs[j].id }
+
+// where top and bottom find the label param's values
+const labelsParam = "_labels"
+
+// returns the 'value' parameter (default 10) highest values, highest first
+// as [{"user": id, "value": value}, ...], with "label" too if the magic has a label var
+func _number_top(src magicSource, params map[string]interface{}) func() interface{} {
+	return ranking(src, params, true)
+}
+
+// like top, but the lowest values, lowest first
+func _number_bottom(src magicSource, params map[string]interface{}) func() interface{} {
+	return ranking(src, params, false)
+}
+
+func ranking(src magicSource, params map[string]interface{}, highest bool) func() interface{} {
+	n := 10
+	if f, ok := toFloat(params["value"]); ok && f >= 1 {
+		n = int(f)
+	}
+	labels, _ := params[labelsParam].(map[*client]interface{})
+	return func() interface{} {
+		values := src.values()
+		clients := make([]*client, 0, len(values))
+		for c := range values {
+			clients = append(clients, c)
+		}
+		sort.Sort(byClientID(clients))
+		sort.Stable(byValue{clients, values, highest})
+		if len(clients) > n {
+			clients = clients[:n]
+		}
+
+		entries := make([]map[string]interface{}, 0, len(clients))
+		for _, c := range clients {
+			entry := map[string]interface{}{
+				"user":  c.id,
+				"value": values[c],
+			}
+			if labels != nil {
+				entry["label"] = labels[c]
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+}
+
+// sorts clients by their number values
+type byValue struct {
+	clients []*client
+	values  map[*client]interface{}
+	desc    bool
+}
+
+func (s byValue) Len() int      { return len(s.clients) }
+func (s byValue) Swap(i, j int) { s.clients[i], s.clients[j] = s.clients[j], s.clients[i] }
+func (s byValue) Less(i, j int) bool {
+	a, _ := toFloat(s.values[s.clients[i]])
+	b, _ := toFloat(s.values[s.clients[j]])
+	if s.desc {
+		return a > b
+	}
+	return a < b
+}
+
+// returns the sum of the values (or the value, for sources that aren't user vars)
+// divided by the 'value' parameter, or 0 if that's 0
+func _number_div(src magicSource, params map[string]interface{}) func() interface{} {
+	return func() interface{} {
+		by, _ := toFloat(params["value"])
+		if by == 0 {
+			return 0.0
+		}
+		sum := 0.0
+		for _, n := range floatValues(src) {
+			sum += n
+		}
+		return sum / by
+	}
+}
+
+// per-viewer magic
+
+// returns the viewer's place, 1 being the highest value
+// users with the same value share a place, and viewers without a value get 0
+func _number_rank(src magicSource, params map[string]interface{}) func() func(*client) interface{} {
+	return func() func(*client) interface{} {
+		values := src.values()
+		// sort once, then everyone's place is a search away
+		sorted := floatValues(src)
+		return func(viewer *client) interface{} {
+			mine, ok := toFloat(values[viewer])
+			if !ok {
+				return 0
+			}
+			higher := len(sorted) - sort.Search(len(sorted), func(i int) bool { return sorted[i] > mine })
+			return higher + 1
+		}
+	}
+}
+
+// returns an object of user ID → value for everyone but the viewer
+func _any_others(src magicSource, params map[string]interface{}) func() func(*client) interface{} {
+	return func() func(*client) interface{} {
+		values := src.values()
+		return func(viewer *client) interface{} {
+			others := make(map[string]interface{}, len(values))
+			for c, val := range values {
+				if c != viewer {
+					others[string(c.id)] = val
+				}
+			}
+			return others
+		}
+	}
+}
+
+// like count, but leaves out the viewer
+func _any_count_others(src magicSource, params map[string]interface{}) func() func(*client) interface{} {
+	cmp, hasCmp := params["value"]
+	srcType := src.srcType()
+	counts := func(v interface{}) bool {
+		if hasCmp {
+			return equal(v, cmp)
+		}
+		return !equal(v, srcType.zero())
+	}
+	return func() func(*client) interface{} {
+		values := src.values()
+		total := 0
+		for _, v := range values {
+			if counts(v) {
+				total++
+			}
+		}
+		return func(viewer *client) interface{} {
+			if v, ok := values[viewer]; ok && counts(v) {
+				return total - 1
+			}
+			return total
+		}
+	}
+}
+
 // returns true if all values are the same
-func _any_same(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _any_same(src magicSource, params map[string]interface{}) func() interface{} {
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		var first interface{}
 		n := 0
 		for _, v := range values {
 			if n == 0 {
 				first = v
 			} else {
-				if v != first {
+				if !equal(v, first) {
 					return false
 				}
 			}
@@ -84,13 +534,13 @@ func _any_same(ch *channel, src identifier, params map[string]interface{}) func(
 
 // returns true if all source values equal the 'value' parameter
 // if no 'value' param is given, checks if all values are non-zero
-func _any_all(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _any_all(src magicSource, params map[string]interface{}) func() interface{} {
 	cmp, ok := params["value"]
 	if ok {
 		return func() interface{} {
-			values, _ := ch.values(src)
+			values := src.values()
 			for _, v := range values {
-				if v != cmp {
+				if !equal(v, cmp) {
 					return false
 				}
 			}
@@ -99,11 +549,11 @@ func _any_all(ch *channel, src identifier, params map[string]interface{}) func()
 	}
 
 	// no comaprison value, so see if every value is non-zero
-	srcType := ch.types[src]
+	srcType := src.srcType()
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		for _, val := range values {
-			if val == srcType.zero() {
+			if equal(val, srcType.zero()) {
 				return false
 			}
 		}
@@ -113,13 +563,13 @@ func _any_all(ch *channel, src identifier, params map[string]interface{}) func()
 
 // returns true if any of the source values equal the 'value' parameter
 // if no 'value' param is given, checks if there are any non-zero values
-func _any_any(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _any_any(src magicSource, params map[string]interface{}) func() interface{} {
 	cmp, ok := params["value"]
 	if ok {
 		return func() interface{} {
-			values, _ := ch.values(src)
+			values := src.values()
 			for _, v := range values {
-				if v == cmp {
+				if equal(v, cmp) {
 					return true
 				}
 			}
@@ -128,11 +578,11 @@ func _any_any(ch *channel, src identifier, params map[string]interface{}) func()
 	}
 
 	// no comaprison value, so see if there's any non-zero values
-	srcType := ch.types[src]
+	srcType := src.srcType()
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		for _, v := range values {
-			if v != srcType.zero() {
+			if !equal(v, srcType.zero()) {
 				return true
 			}
 		}
@@ -142,14 +592,14 @@ func _any_any(ch *channel, src identifier, params map[string]interface{}) func()
 
 // counts the number of sourve values that equal the 'value' parameter
 // if no 'value' param is given, counts the number of non-zero values
-func _any_count(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
+func _any_count(src magicSource, params map[string]interface{}) func() interface{} {
 	cmp, ok := params["value"]
 	if ok {
 		return func() interface{} {
-			values, _ := ch.values(src)
+			values := src.values()
 			ct := 0
 			for _, v := range values {
-				if v == cmp {
+				if equal(v, cmp) {
 					ct++
 				}
 			}
@@ -158,12 +608,12 @@ func _any_count(ch *channel, src identifier, params map[string]interface{}) func
 	}
 
 	// no comaprison value, so count the non-zero values
-	srcType := ch.types[src]
+	srcType := src.srcType()
 	return func() interface{} {
-		values, _ := ch.values(src)
+		values := src.values()
 		ct := 0
 		for _, v := range values {
-			if v != srcType.zero() {
+			if !equal(v, srcType.zero()) {
 				ct++
 			}
 		}
@@ -171,10 +621,13 @@ func _any_count(ch *channel, src identifier, params map[string]interface{}) func
 	}
 }
 
-func _any_percent(ch *channel, src identifier, params map[string]interface{}) func() interface{} {
-	countFunc := _any_count(ch, src, params)
+func _any_percent(src magicSource, params map[string]interface{}) func() interface{} {
+	countFunc := _any_count(src, params)
 	return func() interface{} {
-		listeners := len(ch.listeners)
+		listeners := src.listeners()
+		if listeners == 0 {
+			return 0.0
+		}
 		ct := float64(countFunc().(int))
 		return ct / float64(listeners)
 	}
@@ -186,10 +639,55 @@ func init() {
 	registerMagic(spell{jsInt, "max"}, _int_max, jsInt)
 	registerMagic(spell{jsInt, "min"}, _int_min, jsInt)
 	registerMagic(spell{jsInt, "avg"}, _int_avg, jsInt)
+	registerMagic(spell{jsInt, "div"}, _number_div, jsFloat)
+	registerMagic(spell{jsInt, "top"}, _number_top, jsObjectArray)
+	registerMagic(spell{jsInt, "bottom"}, _number_bottom, jsObjectArray)
+	// float magic
+	registerMagic(spell{jsFloat, "sum"}, _float_sum, jsFloat)
+	registerMagic(spell{jsFloat, "max"}, _float_max, jsFloat)
+	registerMagic(spell{jsFloat, "min"}, _float_min, jsFloat)
+	registerMagic(spell{jsFloat, "avg"}, _float_avg, jsFloat)
+	registerMagic(spell{jsFloat, "median"}, _float_median, jsFloat)
+	registerMagic(spell{jsFloat, "stddev"}, _float_stddev, jsFloat)
+	registerMagic(spell{jsFloat, "percentile"}, _float_percentile, jsFloat)
+	registerMagic(spell{jsFloat, "div"}, _number_div, jsFloat)
+	registerMagic(spell{jsFloat, "top"}, _number_top, jsObjectArray)
+	registerMagic(spell{jsFloat, "bottom"}, _number_bottom, jsObjectArray)
+	// string magic
+	registerMagic(spell{jsString, "join"}, _string_join, jsString)
+	registerMagic(spell{jsString, "list"}, _string_list, jsStringArray)
+	registerMagic(spell{jsString, "unique"}, _string_unique, jsStringArray)
+	registerMagic(spell{jsString, "mode"}, _string_mode, jsString)
+	registerMagic(spell{jsString, "histogram"}, _string_histogram, jsObject)
+	// array magic, giving back the same type of array
+	for _, t := range []jsType{jsBoolArray, jsIntArray, jsFloatArray, jsStringArray, jsObjectArray, jsAnythingArray} {
+		registerMagic(spell{t, "union"}, _array_union, t)
+		registerMagic(spell{t, "intersection"}, _array_intersection, t)
+		registerMagic(spell{t, "concat"}, _array_concat, t)
+	}
+	// per-viewer magic
+	registerViewerMagic(spell{jsInt, "rank"}, _number_rank, jsInt)
+	registerViewerMagic(spell{jsFloat, "rank"}, _number_rank, jsInt)
+	for _, t := range []jsType{jsAnything, jsAnythingArray} {
+		registerViewerMagic(spell{t, "others"}, _any_others, jsObject)
+		registerViewerMagic(spell{t, "count_others"}, _any_count_others, jsInt)
+	}
 	// any type magic
 	registerMagic(spell{jsAnything, "same"}, _any_same, jsBool)
 	registerMagic(spell{jsAnything, "any"}, _any_any, jsBool)
 	registerMagic(spell{jsAnything, "all"}, _any_all, jsBool)
 	registerMagic(spell{jsAnything, "count"}, _any_count, jsInt)
 	registerMagic(spell{jsAnything, "percent"}, _any_percent, jsFloat)
+	// magic that can keep up one value at a time, see tally.go
+	registerTally(spell{jsInt, "sum"}, _int_sum_tally)
+	registerTally(spell{jsInt, "avg"}, _int_avg_tally)
+	registerTally(spell{jsInt, "max"}, _int_max_tally)
+	registerTally(spell{jsInt, "min"}, _int_min_tally)
+	registerTally(spell{jsFloat, "sum"}, _float_sum_tally)
+	registerTally(spell{jsFloat, "avg"}, _float_avg_tally)
+	registerTally(spell{jsFloat, "max"}, _float_max_tally)
+	registerTally(spell{jsFloat, "min"}, _float_min_tally)
+	registerTally(spell{jsString, "histogram"}, _string_histogram_tally)
+	registerTally(spell{jsAnything, "count"}, _any_count_tally)
+	registerTally(spell{jsAnything, "percent"}, _any_percent_tally)
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// magic that keeps a running total, so one user's change doesn't mean going over everyone again
+// a changed value is a remove of the old one then an add of the new one
+type tally interface {
+	add(val interface{})
+	remove(val interface{})
+	value() interface{}
+}
+
+// tally generator, like magicMaker
+type tallyMaker func(magicSource, map[string]interface{}) tally
+
+// lets sig keep up one value at a time
+// the regular magic is still used when a tally can't be (where, group, cross-channel, etc.)
+func registerTally(sig spell, f tallyMaker) {
+	m, ok := grimoire[sig]
+	if !ok {
+		panic("registering a tally for unknown magic: " + sig.String())
+	}
+	m.ft = f
+	grimoire[sig] = m
+}
+
+// a tally for sig, or nil if it doesn't have one
+func makeTally(src magicSource, sig spell, params map[string]interface{}) tally {
+	m, ok := grimoire[sig]
+	if !ok {
+		m, ok = grimoire[sig.generic()]
+	}
+	if !ok || m.ft == nil {
+		return nil
+	}
+	return m.ft(src, params)
+}
+
+// counts values equal to params["value"], or non-zero values
+type countTally struct {
+	match func(interface{}) bool
+	ct    int
+}
+
+func newCountTally(src magicSource, params map[string]interface{}) *countTally {
+	t := &countTally{}
+	if cmp, ok := params["value"]; ok {
+		t.match = func(v interface{}) bool { return equal(v, cmp) }
+	} else {
+		zero := src.srcType().zero()
+		t.match = func(v interface{}) bool { return !equal(v, zero) }
+	}
+	return t
+}
+
+func (t *countTally) add(val interface{}) {
+	if t.match(val) {
+		t.ct++
+	}
+}
+
+func (t *countTally) remove(val interface{}) {
+	if t.match(val) {
+		t.ct--
+	}
+}
+
+func (t *countTally) value() interface{} {
+	return t.ct
+}
+
+func _any_count_tally(src magicSource, params map[string]interface{}) tally {
+	return newCountTally(src, params)
+}
+
+// count over the number of listeners
+type percentTally struct {
+	*countTally
+	src magicSource
+}
+
+func (t percentTally) value() interface{} {
+	listeners := t.src.listeners()
+	if listeners == 0 {
+		return 0.0
+	}
+	return float64(t.ct) / float64(listeners)
+}
+
+func _any_percent_tally(src magicSource, params map[string]interface{}) tally {
+	return percentTally{newCountTally(src, params), src}
+}
+
+// sum and number of values, for sum and avg of ints
+type intSumTally struct {
+	sum int
+	n   int
+	avg bool
+}
+
+func (t *intSumTally) add(val interface{}) {
+	if n, ok := val.(int); ok {
+		t.sum += n
+		t.n++
+	}
+}
+
+func (t *intSumTally) remove(val interface{}) {
+	if n, ok := val.(int); ok {
+		t.sum -= n
+		t.n--
+	}
+}
+
+func (t *intSumTally) value() interface{} {
+	if !t.avg {
+		return t.sum
+	}
+	if t.n == 0 {
+		return 0
+	}
+	return t.sum / t.n
+}
+
+// same for floats
+// uses compensated (Kahan-Babuska) summation, so adding and removing doesn't pile up rounding error
+type floatSumTally struct {
+	sum  float64
+	comp float64 // the low bits sum lost
+	n    int
+	avg  bool
+}
+
+func (t *floatSumTally) plus(x float64) {
+	next := t.sum + x
+	if math.Abs(t.sum) >= math.Abs(x) {
+		t.comp += (t.sum - next) + x
+	} else {
+		t.comp += (x - next) + t.sum
+	}
+	t.sum = next
+}
+
+func (t *floatSumTally) add(val interface{}) {
+	if n, ok := toFloat(val); ok {
+		t.plus(n)
+		t.n++
+	}
+}
+
+func (t *floatSumTally) remove(val interface{}) {
+	if n, ok := toFloat(val); ok {
+		t.plus(-n)
+		t.n--
+		if t.n == 0 {
+			t.sum, t.comp = 0, 0
+		}
+	}
+}
+
+func (t *floatSumTally) value() interface{} {
+	sum := t.sum + t.comp
+	if !t.avg {
+		return sum
+	}
+	if t.n == 0 {
+		return 0.0
+	}
+	return sum / float64(t.n)
+}
+
+func _int_sum_tally(src magicSource, params map[string]interface{}) tally {
+	return &intSumTally{}
+}
+
+func _int_avg_tally(src magicSource, params map[string]interface{}) tally {
+	return &intSumTally{avg: true}
+}
+
+func _float_sum_tally(src magicSource, params map[string]interface{}) tally {
+	return &floatSumTally{}
+}
+
+func _float_avg_tally(src magicSource, params map[string]interface{}) tally {
+	return &floatSumTally{avg: true}
+}
+
+// min or max, using a heap
+// removed values stay in the heap until they get to the top (or there's too many of them)
+type extremeTally struct {
+	h       floatHeap
+	removed map[float64]int
+	live    int
+	ints    bool
+}
+
+func (t *extremeTally) add(val interface{}) {
+	if n, ok := toFloat(val); ok {
+		heap.Push(&t.h, n)
+		t.live++
+	}
+}
+
+func (t *extremeTally) remove(val interface{}) {
+	if n, ok := toFloat(val); ok {
+		t.removed[n]++
+		t.live--
+		if t.h.Len() > 2*t.live+16 {
+			t.compact()
+		}
+	}
+}
+
+// throws out the removed values and rebuilds the heap
+func (t *extremeTally) compact() {
+	nums := t.h.nums[:0]
+	for _, n := range t.h.nums {
+		if t.removed[n] > 0 {
+			t.removed[n]--
+			continue
+		}
+		nums = append(nums, n)
+	}
+	t.h.nums = nums
+	t.removed = make(map[float64]int)
+	heap.Init(&t.h)
+}
+
+func (t *extremeTally) value() interface{} {
+	for t.h.Len() > 0 {
+		top := t.h.nums[0]
+		if t.removed[top] == 0 {
+			break
+		}
+		t.removed[top]--
+		if t.removed[top] == 0 {
+			delete(t.removed, top)
+		}
+		heap.Pop(&t.h)
+	}
+	if t.h.Len() == 0 {
+		if t.ints {
+			return 0
+		}
+		return 0.0
+	}
+	if t.ints {
+		return int(t.h.nums[0])
+	}
+	return t.h.nums[0]
+}
+
+func newExtremeTally(max, ints bool) *extremeTally {
+	return &extremeTally{
+		h:       floatHeap{max: max},
+		removed: make(map[float64]int),
+		ints:    ints,
+	}
+}
+
+func _int_max_tally(src magicSource, params map[string]interface{}) tally {
+	return newExtremeTally(true, true)
+}
+
+func _int_min_tally(src magicSource, params map[string]interface{}) tally {
+	return newExtremeTally(false, true)
+}
+
+func _float_max_tally(src magicSource, params map[string]interface{}) tally {
+	return newExtremeTally(true, false)
+}
+
+func _float_min_tally(src magicSource, params map[string]interface{}) tally {
+	return newExtremeTally(false, false)
+}
+
+// container/heap of float64s, smallest (or biggest) on top
+type floatHeap struct {
+	nums []float64
+	max  bool
+}
+
+func (h floatHeap) Len() int { return len(h.nums) }
+func (h floatHeap) Less(i, j int) bool {
+	if h.max {
+		return h.nums[i] > h.nums[j]
+	}
+	return h.nums[i] < h.nums[j]
+}
+func (h floatHeap) Swap(i, j int)       { h.nums[i], h.nums[j] = h.nums[j], h.nums[i] }
+func (h *floatHeap) Push(x interface{}) { h.nums = append(h.nums, x.(float64)) }
+func (h *floatHeap) Pop() interface{} {
+	last := h.nums[len(h.nums)-1]
+	h.nums = h.nums[:len(h.nums)-1]
+	return last
+}
+
+// how many of each string there are
+type histogramTally map[string]int
+
+func (t histogramTally) add(val interface{}) {
+	if str, ok := val.(string); ok {
+		t[str]++
+	}
+}
+
+func (t histogramTally) remove(val interface{}) {
+	if str, ok := val.(string); ok {
+		t[str]--
+		if t[str] <= 0 {
+			delete(t, str)
+		}
+	}
+}
+
+func (t histogramTally) value() interface{} {
+	// a copy, since the cache holds on to it
+	hist := make(map[string]interface{}, len(t))
+	for str, n := range t {
+		hist[str] = n
+	}
+	return hist
+}
+
+func _string_histogram_tally(src magicSource, params map[string]interface{}) tally {
+	return make(histogramTally)
+}
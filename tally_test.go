@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// a channel with 2000 users and some magic on their %score
+func benchChannel(tallied bool) (*channel, []*client) {
+	score := identifier{'%', "score", UserVar}
+	templates['b'] = channelTemplate{
+		Prefix: "b",
+		Vars:   map[string]*varDef{"score": {Type: jsInt}},
+		Magic: map[string]*magicDef{
+			"sum":   {Src: score, Func: "sum"},
+			"avg":   {Src: score, Func: "avg"},
+			"max":   {Src: score, Func: "max"},
+			"count": {Src: score, Func: "count"},
+		},
+	}
+	ch := newChannel(fmt.Sprintf("bench-%v", tallied))
+	if !tallied {
+		// go back to going over every value
+		ch.tallies = make(map[identifier][]tally)
+		for name, m := range templates['b'].Magic {
+			v := identifier{'&', name, MagicVar}
+			ch.magic[v] = makeMagic(userVarSource{ch, score}, spell{jsInt, m.Func}, nil)
+		}
+	}
+
+	// everyone shares one queue, so sending is cheap
+	sendq := make(chan interface{}, 1024)
+	go func() {
+		for range sendq {
+		}
+	}()
+	users := make([]*client, 2000)
+	for i := range users {
+		c := &client{id: clientID(fmt.Sprint(i)), sendq: sendq}
+		ch.listeners[c] = true
+		ch.setUserValue(score, c, i%100)
+		users[i] = c
+	}
+	ch.invalidate(score)
+	return ch, users
+}
+
+func benchmarkSet(b *testing.B, tallied bool) {
+	ch, users := benchChannel(tallied)
+	score := identifier{'%', "score", UserVar}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := users[i%len(users)]
+		// 97 so the values keep changing from one round to the next
+		ch.setVar(nil, c, score, i%97, nil)
+	}
+}
+
+func BenchmarkSetTally(b *testing.B) {
+	benchmarkSet(b, true)
+}
+
+func BenchmarkSetRecompute(b *testing.B) {
+	benchmarkSet(b, false)
+}
@@ -1,14 +1,26 @@
 package main
 
-import "unicode/utf8"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 type channelTemplate struct {
 	Prefix    string
 	Expose    []identifier // special $vars to expose
+	Users     []identifier // public user vars to include in $users
+	Rooms     *roomsDef    // channels to list in $rooms
 	Restrict  []string
 	Vars      map[string]*varDef `toml:"var"`
 	Magic     map[string]*magicDef
 	Broadcast map[string]*broadcast
+	Chan      map[string]*chanvarDef
 	Wire      map[string]*wireDef
 }
 
@@ -18,12 +30,36 @@ func (tmpl channelTemplate) apply(ch *channel) {
 	ch.prefix = prefix
 	// restrict
 	ch.restrict = tmpl.Restrict
+	// does some lobby's magic want our values?
+	for _, v := range aggregatedVars(ch.name) {
+		ch.aggregated[v] = true
+	}
+	// are we in some lobby's $rooms?
+	if roomsWatched(prefix) {
+		ch.listed = true
+		ch.shared = sharedRoomVars(prefix)
+	}
 	// expose
 	for _, v := range tmpl.Expose {
 		ch.index[v] = false // system vars are read-only
 		switch v {
 		case listenersSysVar:
 			ch.vars[listenersSysVar] = 0
+		case usersSysVar:
+			ch.vars[usersSysVar] = []map[string]interface{}{}
+			for _, uv := range tmpl.Users {
+				ch.roster[uv] = true
+			}
+		case channelSysVar, serverSysVar, userIDSysVar, joinedAtSysVar:
+			// these are looked up as needed, see channel.sysValue
+		case clientsSysVar, channelsSysVar, uptimeSysVar, timeSysVar:
+			ch.vars[v] = globalValue(v)
+			ch.globals = true
+		case roomsSysVar:
+			ch.vars[v] = []map[string]interface{}{}
+			if tmpl.Rooms != nil {
+				ch.lobby = tmpl.Rooms.prefix()
+			}
 		default:
 			panic("Unknown system var in expose: " + v.String())
 		}
@@ -38,9 +74,49 @@ func (tmpl channelTemplate) apply(ch *channel) {
 		ch.index[v] = !def.ReadOnly
 		ch.uservars[v] = make(map[*client]interface{})
 		ch.types[v] = def.Type
+		ch.defaults[v] = typedDefault(def.Type, def.Default)
+		if def.Public {
+			ch.public[v] = true
+		}
+		ch.limit(v, &def.constraints, def.Schema)
+	}
+	// broadcast vars
+	for name, def := range tmpl.Broadcast {
+		v := identifier{
+			sigil: '#',
+			name:  name,
+			kind:  BroadcastVar,
+		}
+		ch.index[v] = !def.ReadOnly
+		ch.types[v] = def.Type
+		ch.vars[v] = typedDefault(def.Type, def.Default)
+		if len(def.Restrict) > 0 {
+			ch.writers[v] = def.Restrict
+		}
+		ch.limit(v, &def.constraints, def.Schema)
+	}
+	// channel vars
+	for name, def := range tmpl.Chan {
+		v := identifier{
+			sigil: '@',
+			name:  name,
+			kind:  ChannelVar,
+		}
+		// only privileged clients (and the API) can set these
+		ch.index[v] = len(def.Restrict) > 0
+		ch.types[v] = def.Type
+		ch.vars[v] = typedDefault(def.Type, def.Default)
+		if len(def.Restrict) > 0 {
+			ch.writers[v] = def.Restrict
+		}
+		ch.limit(v, &def.constraints, def.Schema)
 	}
-	// TODO: channel vars?
 	// magic
+	// config.check made sure there aren't any cycles
+	order, _ := tmpl.magicOrder()
+	for _, name := range order {
+		ch.order = append(ch.order, identifier{sigil: '&', name: name, kind: MagicVar})
+	}
 	for name, m := range tmpl.Magic {
 		v := identifier{
 			sigil: '&',
@@ -48,12 +124,108 @@ func (tmpl channelTemplate) apply(ch *channel) {
 			kind:  MagicVar,
 		}
 		ch.index[v] = false // all magic is read-only
-		srcVar := tmpl.Vars[m.Src.name]
-		s := spell{srcVar.Type, m.Func}
-		ch.magic[v] = makeMagic(ch, m.Src, s, m.Params)
-		ch.deps[m.Src] = append(ch.deps[m.Src], v)
+		if m.throttle > 0 || m.debounce > 0 {
+			ch.paced[v] = &pacer{throttle: m.throttle, debounce: m.debounce}
+		}
+		if m.expr != nil {
+			e := m.expr
+			ch.magic[v] = func() interface{} {
+				val, err := e.eval(ch.peek)
+				if err != nil {
+					// keep the old value rather than telling everyone null
+					log.Printf("%s: %s: %s", ch.name, v, err)
+					return ch.cache[v]
+				}
+				return val
+			}
+			for _, in := range e.vars() {
+				ch.deps[in] = append(ch.deps[in], v)
+			}
+			ch.cache[v] = tmpl.magicType(m, templates).zero()
+			continue
+		}
+		var src magicSource
+		var srcType jsType
+		if m.cross() {
+			// values come from other channels, see aggregate.go
+			sc := m.scope()
+			srcType = sc.srcType(templates, m.Src)
+			src = aggSource{sc, m.Src, srcType}
+			ch.cross = append(ch.cross, v)
+			ch.watching = append(ch.watching, sc)
+		} else if m.Src.kind == UserVar {
+			srcType = tmpl.Vars[m.Src.name].Type
+			src = userVarSource{ch, m.Src}
+			ch.deps[m.Src] = append(ch.deps[m.Src], v)
+		} else {
+			// built on other magic, $listeners, etc.
+			srcType = tmpl.varType(m.Src, templates)
+			src = scalarSource{ch, m.Src, srcType}
+			ch.deps[m.Src] = append(ch.deps[m.Src], v)
+		}
+		if m.cond != nil {
+			on := ch.magicInput(m, v, m.cond.v)
+			src = filteredSource{src, m.cond, on}
+		}
+		cast := makeMagic
+		if m.grouped() {
+			by := ch.magicInput(m, v, m.Group)
+			cast = func(src magicSource, s spell, params map[string]interface{}) func() interface{} {
+				return makeGroupMagic(src, by, s, params)
+			}
+		}
+		var labels magicSource
+		if m.labeled() {
+			labels = ch.magicInput(m, v, m.Label)
+		}
+		s := spell{srcType, m.Func}
+		refs := m.refs()
+		for _, ref := range refs {
+			ch.deps[ref] = append(ch.deps[ref], v)
+		}
+		// params pointing at channel vars (and labels) have to be looked up every time
+		dynamic := len(refs) > 0 || labels != nil
+		params, vars := m.Params, m.vars
+		resolve := func() map[string]interface{} {
+			resolved := ch.resolve(params, vars)
+			if labels != nil {
+				resolved[labelsParam] = labels.values()
+			}
+			return resolved
+		}
+		if isViewerMagic(s) {
+			// everyone gets their own value, see recompute
+			if dynamic {
+				ch.viewerMagic[v] = func() func(*client) interface{} {
+					return makeViewerMagic(src, s, resolve())()
+				}
+			} else {
+				ch.viewerMagic[v] = makeViewerMagic(src, s, params)
+			}
+			ch.viewerCache[v] = make(uservarMap)
+			continue
+		}
+		// plain magic on one of our user vars can keep a running total instead, see tally.go
+		var t tally
+		if m.Src.kind == UserVar && !m.cross() && m.cond == nil && !m.grouped() && !dynamic {
+			t = makeTally(src, s, params)
+		}
+		if t != nil {
+			ch.magic[v] = t.value
+			ch.tallies[m.Src] = append(ch.tallies[m.Src], t)
+		} else if dynamic {
+			ch.magic[v] = func() interface{} {
+				return cast(src, s, resolve())()
+			}
+		} else {
+			ch.magic[v] = cast(src, s, params)
+		}
 		// set default value for magic cache
-		ch.cache[v] = defaultValue(s)
+		if m.grouped() {
+			ch.cache[v] = jsObject.zero()
+		} else {
+			ch.cache[v] = defaultValue(s)
+		}
 	}
 	// wires
 	// TODO: some kind of generic function chain thingy
@@ -64,6 +236,7 @@ func (tmpl channelTemplate) apply(ch *channel) {
 			kind:  WireVar,
 		}
 		ch.index[v] = !def.ReadOnly
+		ch.types[v] = def.Type
 		w := wire{} // our baby wire
 		w.inputType = def.Type
 		w.outputType = def.Type
@@ -71,13 +244,22 @@ func (tmpl channelTemplate) apply(ch *channel) {
 			w.rewrite = true
 			w.outputType = jsObject
 			w.transform = func(ch *channel, _wire wire, from *client, input interface{}) interface{} {
-				return def.Rewrite.transform(ch, from, input)
+				return def.Rewrite.transform(ch, v, from, input)
 			}
 		}
 		ch.wires[v] = w
+		ch.limit(v, &def.constraints, def.Schema)
 	}
 }
 
+// can this client join? restrict lists roles or login keys
+func (tmpl channelTemplate) allows(c *client) bool {
+	if len(tmpl.Restrict) == 0 {
+		return true
+	}
+	return c.matches(tmpl.Restrict)
+}
+
 func (tmpl channelTemplate) defines(v identifier) bool {
 	switch v.kind {
 	case UserVar:
@@ -86,10 +268,12 @@ func (tmpl channelTemplate) defines(v identifier) bool {
 		return tmpl.Magic[v.name] != nil
 	case BroadcastVar:
 		return tmpl.Broadcast[v.name] != nil
+	case ChannelVar:
+		return tmpl.Chan[v.name] != nil
 	case WireVar:
 		return tmpl.Wire[v.name] != nil
 	case SystemVar:
-		return true // TODO: proper lookup
+		return exposable[v] || v == inputSysVar
 	}
 	return false
 }
@@ -97,7 +281,72 @@ func (tmpl channelTemplate) defines(v identifier) bool {
 type varDef struct {
 	Type     jsType
 	ReadOnly bool
+	Public   bool // everyone gets to see everyone's value
 	Default  interface{}
+	Schema   *schema
+	constraints
+}
+
+type chanvarDef struct {
+	Type     jsType
+	Default  interface{}
+	Restrict []string // roles or keys allowed to set this, otherwise API only
+	Schema   *schema
+	constraints
+}
+
+// typed default value from the config, or zero if there isn't one
+func typedDefault(t jsType, def interface{}) interface{} {
+	if def == nil {
+		return t.zero()
+	}
+	val, _ := t.normalize(def)
+	return val
+}
+
+// fills in a string default value:
+// %d = join number, %u = user ID, %c = channel name, %% = %
+func expandDefault(tmpl string, n int, id clientID, channel string) string {
+	if !strings.ContainsRune(tmpl, '%') {
+		return tmpl
+	}
+	var out []byte
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i == len(tmpl)-1 {
+			out = append(out, tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'd':
+			out = strconv.AppendInt(out, int64(n), 10)
+		case 'u':
+			out = append(out, id...)
+		case 'c':
+			out = append(out, channel...)
+		case '%':
+			out = append(out, '%')
+		default:
+			out = append(out, '%', tmpl[i])
+		}
+	}
+	return string(out)
+}
+
+// returns the first bad %x in a default string, or "" if it's fine
+func badDefaultVerb(tmpl string) string {
+	for i := 0; i < len(tmpl)-1; i++ {
+		if tmpl[i] != '%' {
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'd', 'u', 'c', '%':
+		default:
+			return tmpl[i-1 : i+1]
+		}
+	}
+	return ""
 }
 
 type magicDef struct {
@@ -105,6 +354,189 @@ type magicDef struct {
 	Func   string
 	Param  interface{} // shortcut for Params["value"]
 	Params map[string]interface{}
+
+	// cross-channel magic, see aggregate.go
+	Across   string   // prefix of the channels to read src from
+	Channels []string // or the names of the channels
+
+	Where string                // only count users passing this, like '%team == "red"'
+	Group identifier            // cast the spell once for each value of this user var
+	Value string                // an expression instead of src and func, see expr.go
+	expr  *expr                 // compiled value
+	Label identifier            // user var to show next to each user, for top and bottom
+	cond  *condition            // compiled where, see where.go
+	errs  []string              // config problems found by prepare, reported by config.check
+	vars  map[string]identifier // params pointing at vars, see paramRef
+
+	// for magic that changes a lot, see pacer
+	Throttle string // recompute at most once this often, like "100ms"
+	Debounce string // or only once things have been quiet this long
+	throttle time.Duration
+	debounce time.Duration
+}
+
+func (m magicDef) cross() bool {
+	return m.Across != "" || len(m.Channels) > 0
+}
+
+func (m magicDef) grouped() bool {
+	return m.Group.name != ""
+}
+
+func (m magicDef) labeled() bool {
+	return m.Label.name != ""
+}
+
+// other user vars the magic reads, by option name
+func (m magicDef) inputs() map[string]identifier {
+	inputs := make(map[string]identifier)
+	if m.grouped() {
+		inputs["group"] = m.Group
+	}
+	if m.labeled() {
+		inputs["label"] = m.Label
+	}
+	return inputs
+}
+
+// vars referenced by params, like param = "@answer"
+func (m magicDef) refs() []identifier {
+	var refs []identifier
+	for _, v := range m.vars {
+		refs = append(refs, v)
+	}
+	return refs
+}
+
+// params can point at channel, broadcast, magic and system vars
+// strings starting with ' are never vars, so '$5 is just "$5" (see config.prepare)
+func paramRef(p interface{}) (v identifier, ok bool) {
+	str, isStr := p.(string)
+	if !isStr || len(str) < 2 {
+		return v, false
+	}
+	if err := v.UnmarshalText([]byte(str)); err != nil {
+		return v, false
+	}
+	switch v.kind {
+	case ChannelVar, BroadcastVar, MagicVar, SystemVar:
+		return v, true
+	}
+	return v, false
+}
+
+// every var the magic reads
+func (m magicDef) reads() []identifier {
+	if m.expr != nil {
+		return m.expr.vars()
+	}
+	reads := append([]identifier{m.Src}, m.refs()...)
+	if m.cond != nil {
+		reads = append(reads, m.cond.v)
+	}
+	for _, v := range m.inputs() {
+		reads = append(reads, v)
+	}
+	return reads
+}
+
+// type of v, or jsNone if we don't know it
+// all is every template by prefix, for cross-channel magic
+func (tmpl channelTemplate) varType(v identifier, all map[rune]channelTemplate) jsType {
+	switch v.kind {
+	case UserVar:
+		if def := tmpl.Vars[v.name]; def != nil {
+			return def.Type
+		}
+	case BroadcastVar:
+		if def := tmpl.Broadcast[v.name]; def != nil {
+			return def.Type
+		}
+	case ChannelVar:
+		if def := tmpl.Chan[v.name]; def != nil {
+			return def.Type
+		}
+	case SystemVar:
+		if t, ok := sysVarTypes[v]; ok {
+			return t
+		}
+	case MagicVar:
+		if m := tmpl.Magic[v.name]; m != nil {
+			return tmpl.magicType(m, all)
+		}
+	}
+	return jsNone
+}
+
+// type of the values magic gives (don't call this if there are cycles)
+func (tmpl channelTemplate) magicType(m *magicDef, all map[rune]channelTemplate) jsType {
+	if m.expr != nil {
+		t, err := m.expr.check(tmpl.exprTypes(all))
+		if err != nil {
+			return jsNone
+		}
+		return t
+	}
+	if m.grouped() {
+		return jsObject
+	}
+	return returnType(spell{tmpl.magicSrcType(m, all), m.Func})
+}
+
+func (tmpl channelTemplate) magicSrcType(m *magicDef, all map[rune]channelTemplate) jsType {
+	if m.cross() {
+		return m.scope().srcType(all, m.Src)
+	}
+	return tmpl.varType(m.Src, all)
+}
+
+// names of all the magic, ordered so everything comes after the magic it reads
+// if some magic (indirectly) reads itself, returns the cycle instead
+func (tmpl channelTemplate) magicOrder() (order []string, cycle []string) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch state[name] {
+		case visited:
+			return true
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle = append(append([]string{}, path[i:]...), name)
+				}
+			}
+			return false
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, v := range tmpl.Magic[name].reads() {
+			if v.kind == MagicVar && tmpl.Magic[v.name] != nil && !visit(v.name) {
+				return false
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return true
+	}
+
+	names := make([]string, 0, len(tmpl.Magic))
+	for name := range tmpl.Magic {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !visit(name) {
+			return nil, cycle
+		}
+	}
+	return order, nil
 }
 
 // there's a TOML parsing bug workaround here, see config.go
@@ -113,31 +545,106 @@ type wireDef struct {
 	RewriteStrings map[string]string `toml:"rewrite"`
 	Rewrite        rewriteDef        `toml:"-"`
 	ReadOnly       bool
+	Schema         *schema
+	constraints
 }
 
 func (w wireDef) hasRewrite() bool {
 	return len(w.RewriteStrings) > 0
 }
 
-type rewriteDef map[string]identifier
+type rewriteDef map[string]rewriteRule
 
-func (rw rewriteDef) transform(ch *channel, from *client, input interface{}) map[string]interface{} {
-	transformed := make(map[string]interface{})
-	for field, v := range rw {
+// one field of a rewritten message: a var, a 'literal, or an expression (see expr.go)
+type rewriteRule struct {
+	v    identifier
+	expr *expr
+	err  error // from parsing, reported by config.check
+}
+
+func parseRewriteRule(str string) rewriteRule {
+	var v identifier
+	if err := v.UnmarshalText([]byte(str)); err == nil && (v.kind == LiteralString || isPlainName(v.name)) {
+		return rewriteRule{v: v}
+	}
+	e, err := parseExpr(str)
+	return rewriteRule{expr: e, err: err}
+}
+
+func isPlainName(name string) bool {
+	for _, r := range name {
+		if !isNameRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rw rewriteDef) transform(ch *channel, w identifier, from *client, input interface{}) map[string]interface{} {
+	lookup := func(v identifier) interface{} {
 		switch v.kind {
 		case LiteralString:
-			transformed[field] = v.name
+			return v.name
 		case SystemVar:
 			// special case for $input
-			if v.name == "input" {
-				transformed[field] = input
+			if v == inputSysVar {
+				return input
+			}
+			// these work even if they aren't exposed
+			return ch.sysValue(v, from)
+		}
+		value, _ := ch.value(v, from)
+		return value
+	}
+
+	transformed := make(map[string]interface{})
+	for field, rule := range rw {
+		if rule.expr != nil {
+			val, err := rule.expr.eval(lookup)
+			if err != nil {
+				// leave the field out rather than sending null
+				log.Printf("%s: %s.%s: %s", ch.name, w, field, err)
 				continue
 			}
-			fallthrough
-		default:
-			value, _ := ch.value(v, from)
-			transformed[field] = value
+			transformed[field] = val
+		} else {
+			transformed[field] = lookup(rule.v)
 		}
 	}
 	return transformed
 }
+
+// types of the vars a rewrite expression can read
+func (tmpl channelTemplate) rewriteTypes(w *wireDef, all map[rune]channelTemplate) typeLookup {
+	return func(v identifier) (jsType, error) {
+		switch {
+		case v == inputSysVar:
+			return w.Type, nil
+		case v == userIDSysVar:
+			return jsString, nil
+		case v == joinedAtSysVar:
+			return jsInt, nil
+		case v.kind == WireVar:
+			return jsNone, fmt.Errorf("%s is a wire, it can't be read", v)
+		case !tmpl.defines(v):
+			return jsNone, fmt.Errorf("%s is not defined, did you forget %s?", v, definedIn(v))
+		}
+		return tmpl.varType(v, all), nil
+	}
+}
+
+// types of the vars a magic value expression can read
+func (tmpl channelTemplate) exprTypes(all map[rune]channelTemplate) typeLookup {
+	return func(v identifier) (jsType, error) {
+		if v.kind == UserVar {
+			return jsNone, fmt.Errorf("%s is a user var, which has a value for every user (try src and func)", v)
+		}
+		if msg := tmpl.checkMagicInput(v); msg != "" {
+			return jsNone, errors.New(msg)
+		}
+		if tmpl.perViewer(v, all) {
+			return jsNone, fmt.Errorf("%s is different for every user, other magic can't read it", v)
+		}
+		return tmpl.varType(v, all), nil
+	}
+}
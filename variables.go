@@ -20,6 +20,7 @@ const (
 )
 
 var sigilTable = map[rune]varKind{
+	'@':  ChannelVar,
 	'%':  UserVar,
 	'&':  MagicVar,
 	'$':  SystemVar,
@@ -32,10 +33,50 @@ var sigilTable = map[rune]varKind{
 var (
 	// for channels
 	listenersSysVar = identifier{'$', "listeners", SystemVar} // $listeners
+	usersSysVar     = identifier{'$', "users", SystemVar}     // $users
+	channelSysVar   = identifier{'$', "channel", SystemVar}   // $channel
+	serverSysVar    = identifier{'$', "server", SystemVar}    // $server
+	roomsSysVar     = identifier{'$', "rooms", SystemVar}     // $rooms
+	// for the whole server
+	clientsSysVar  = identifier{'$', "clients", SystemVar}  // $clients
+	channelsSysVar = identifier{'$', "channels", SystemVar} // $channels
+	uptimeSysVar   = identifier{'$', "uptime", SystemVar}   // $uptime
+	timeSysVar     = identifier{'$', "time", SystemVar}     // $time
 	// for users
-	userIDSysVar = identifier{'$', "userid", SystemVar} // $userid
+	userIDSysVar   = identifier{'$', "userid", SystemVar}   // $userid
+	joinedAtSysVar = identifier{'$', "joinedAt", SystemVar} // $joinedAt
+	// for wire rewrites
+	inputSysVar = identifier{'$', "input", SystemVar} // $input
 )
 
+// system vars you can put in [channel] expose
+var exposable = map[identifier]bool{
+	listenersSysVar: true,
+	usersSysVar:     true,
+	channelSysVar:   true,
+	serverSysVar:    true,
+	userIDSysVar:    true,
+	joinedAtSysVar:  true,
+	clientsSysVar:   true,
+	channelsSysVar:  true,
+	uptimeSysVar:    true,
+	timeSysVar:      true,
+	roomsSysVar:     true,
+}
+
+// types of the system vars magic can read
+var sysVarTypes = map[identifier]jsType{
+	listenersSysVar: jsInt,
+	usersSysVar:     jsObjectArray,
+	channelSysVar:   jsString,
+	serverSysVar:    jsString,
+	roomsSysVar:     jsObjectArray,
+	clientsSysVar:   jsInt,
+	channelsSysVar:  jsInt,
+	uptimeSysVar:    jsInt,
+	timeSysVar:      jsInt,
+}
+
 var blankIdentifier = identifier{}
 
 type identifier struct {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// [channel.magic.X] where = '%team == "red"'
+// only users whose other user var passes the test count towards the magic
+
+type condition struct {
+	v     identifier
+	op    string
+	value interface{}
+}
+
+var conditionRE = regexp.MustCompile(`^\s*(%\S+)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*$`)
+
+func parseCondition(str string) (*condition, error) {
+	m := conditionRE.FindStringSubmatch(str)
+	if m == nil {
+		return nil, fmt.Errorf("can't understand %q, try something like '%%team == \"red\"'", str)
+	}
+	cond := &condition{op: m[2]}
+	if err := cond.v.UnmarshalText([]byte(m[1])); err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := decode([]byte(m[3]), &value); err != nil {
+		return nil, fmt.Errorf("bad value %s (strings need quotes)", m[3])
+	}
+	cond.value = plainNumbers(value)
+	return cond, nil
+}
+
+// gets the condition ready to test values of type t
+func (cond *condition) compile(t jsType) error {
+	val, ok := t.normalize(cond.value)
+	if !ok {
+		return fmt.Errorf("%v is not a %s", cond.value, t)
+	}
+	cond.value = val
+	switch cond.op {
+	case "==", "!=":
+		return nil
+	}
+	if t != jsInt && t != jsFloat && t != jsString {
+		return fmt.Errorf("%s only works on numbers and strings, not %s", cond.op, t)
+	}
+	return nil
+}
+
+func (cond *condition) test(x interface{}) bool {
+	switch cond.op {
+	case "==":
+		return equal(x, cond.value)
+	case "!=":
+		return !equal(x, cond.value)
+	}
+	cmp, ok := compare(x, cond.value)
+	if !ok {
+		return false
+	}
+	switch cond.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// -1, 0, or 1 for two numbers or two strings
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// magic source with only the users passing the condition
+type filteredSource struct {
+	magicSource
+	cond *condition
+	on   magicSource // where to get the values of cond.v
+}
+
+func (s filteredSource) values() map[*client]interface{} {
+	pass := s.passing()
+	values := make(map[*client]interface{})
+	for c, val := range s.magicSource.values() {
+		if pass[c] {
+			values[c] = val
+		}
+	}
+	return values
+}
+
+// only the users passing count, so percent gives e.g. the percent of the red team that's ready
+func (s filteredSource) listeners() int {
+	return len(s.passing())
+}
+
+func (s filteredSource) passing() map[*client]bool {
+	pass := make(map[*client]bool)
+	for c, val := range s.on.values() {
+		if s.cond.test(val) {
+			pass[c] = true
+		}
+	}
+	return pass
+}